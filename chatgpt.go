@@ -11,13 +11,19 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/debug"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/artyom/retry"
@@ -26,80 +32,320 @@ import (
 
 const openaiTokenEnv = "OPENAI_API_KEY"
 
+// openaiAPI describes where to send OpenAI API requests, and how to
+// authenticate them.
+type openaiAPI struct {
+	chatURL   string      // chat completions or responses endpoint
+	statusURL string      // endpoint to check credentials with -status
+	auth      http.Header // headers authenticating requests
+	responses bool        // whether chatURL is of Responses API
+}
+
+// newOpenaiAPI returns either Azure OpenAI API configuration, if
+// LLMCLI_AZURE_ENDPOINT is set, or the default OpenAI one.
+// If LLMCLI_OPENAI_RESPONSES is set, requests go to Responses API instead of
+// chat completions. LLMCLI_OPENAI_PATH replaces the path of the endpoint, for
+// OpenAI-compatible gateways that serve the API elsewhere.
+func newOpenaiAPI(model string) (*openaiAPI, error) {
+	responses := useResponsesAPI()
+	endpoint := os.Getenv("LLMCLI_AZURE_ENDPOINT")
+	if endpoint == "" {
+		token := os.Getenv(openaiTokenEnv)
+		if token == "" {
+			return nil, errors.New(openaiTokenEnv + " must be set")
+		}
+		base := "https://api.openai.com"
+		if s := os.Getenv("LLMCLI_OPENAI_BASE_URL"); s != "" {
+			if u, err := url.Parse(s); err != nil || u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("LLMCLI_OPENAI_BASE_URL must be an absolute url, got %q", s)
+			}
+			base = strings.TrimSuffix(s, "/")
+		}
+		api := &openaiAPI{
+			chatURL:   base + "/v1/chat/completions",
+			statusURL: base + "/v1/models/" + url.PathEscape(model),
+			auth:      http.Header{"Authorization": {"Bearer " + token}},
+			responses: responses,
+		}
+		if responses {
+			api.chatURL = base + "/v1/responses"
+		}
+		// attribute usage to the particular organization and project of
+		// the user who has access to several ones
+		if org := os.Getenv("OPENAI_ORG_ID"); org != "" {
+			api.auth.Set("OpenAI-Organization", org)
+		}
+		if project := os.Getenv("OPENAI_PROJECT_ID"); project != "" {
+			api.auth.Set("OpenAI-Project", project)
+		}
+		if p := os.Getenv("LLMCLI_OPENAI_PATH"); p != "" {
+			var err error
+			if api.chatURL, err = openaiPathURL(base, p, ""); err != nil {
+				return nil, err
+			}
+		}
+		return api, nil
+	}
+	// https://learn.microsoft.com/en-us/azure/ai-services/openai/reference
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("LLMCLI_AZURE_ENDPOINT must be an absolute url, got %q", endpoint)
+	}
+	key := os.Getenv("LLMCLI_AZURE_API_KEY")
+	if key == "" {
+		return nil, errors.New("LLMCLI_AZURE_API_KEY must be set")
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	query := "?api-version=" + url.QueryEscape(cmp.Or(os.Getenv("LLMCLI_AZURE_API_VERSION"), "2024-10-21"))
+	api := &openaiAPI{
+		// with Azure, LLMCLI_CHATGPT_MODEL is the name of the deployment
+		chatURL:   endpoint + "/openai/deployments/" + url.PathEscape(model) + "/chat/completions" + query,
+		statusURL: endpoint + "/openai/models" + query,
+		auth:      http.Header{"Api-Key": {key}},
+		responses: responses,
+	}
+	if responses {
+		// Responses API needs a preview LLMCLI_AZURE_API_VERSION
+		api.chatURL = endpoint + "/openai/responses" + query
+	}
+	if p := os.Getenv("LLMCLI_OPENAI_PATH"); p != "" {
+		var err error
+		if api.chatURL, err = openaiPathURL(endpoint, p, query); err != nil {
+			return nil, err
+		}
+	}
+	return api, nil
+}
+
+// openaiPathURL returns the url of the endpoint at path set with
+// LLMCLI_OPENAI_PATH, with the query appended.
+func openaiPathURL(base, path, query string) (string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("LLMCLI_OPENAI_PATH must start with /, got %q", path)
+	}
+	s := base + path
+	if query != "" {
+		if strings.Contains(path, "?") {
+			query = "&" + query[1:]
+		}
+		s += query
+	}
+	if _, err := url.Parse(s); err != nil {
+		return "", fmt.Errorf("LLMCLI_OPENAI_PATH: %w", err)
+	}
+	return s, nil
+}
+
 func chatgpt(ctx context.Context, args runArgs) error {
-	token := os.Getenv(openaiTokenEnv)
-	if token == "" {
-		return errors.New(openaiTokenEnv + " must be set")
+	if len(args.diff) != 0 {
+		return errors.New("-diff flag is not supported by chatgpt")
+	}
+	if args.fast {
+		return errors.New("-fast flag is not supported by chatgpt")
+	}
+	if args.summarizeOver > 0 {
+		return errors.New("-summarize-attachments flag is not supported by chatgpt")
+	}
+	if args.script {
+		return errors.New("-script flag is not supported by chatgpt")
+	}
+	if len(args.responseFields) != 0 {
+		return errors.New("-response-field flag is not supported by chatgpt")
+	}
+	if args.metadata != nil {
+		return errors.New("-metadata flag is not supported by chatgpt")
+	}
+	api, err := newOpenaiAPI(args.config.chatgptModel())
+	if err != nil {
+		return err
 	}
 
+	if api.responses && args.seed != nil {
+		return errors.New("-seed flag is not supported by Responses API")
+	}
+	if api.responses && args.logprobs != nil {
+		return errors.New("-logprobs flag is not supported by Responses API")
+	}
+	roles := chatRoles()
+	if api.responses && roles != defaultChatRoles {
+		return errors.New("LLMCLI_OPENAI_*_ROLE environment variables are not supported by Responses API")
+	}
+	if api.responses && args.infer != nil && len(args.infer.StopSequences) != 0 {
+		return errors.New("stopSequences of -infer flag are not supported by Responses API")
+	}
 	prompt, err := readPrompt(args)
 	if err != nil {
 		return err
 	}
-	var systemPrompt []byte
-	if args.sys != "" {
-		if b, err := os.ReadFile(args.sys); err == nil {
-			b = bytes.TrimSpace(b)
-			if len(b) != 0 && utf8.Valid(b) {
-				systemPrompt = b
-			}
-		}
-	}
+	started := time.Now() // for -summary, not counting time to type the prompt
+	systemPrompt := userSystemPrompt(args)
 	systemPrompt = time.Now().Local().AppendFormat(systemPrompt, "\nToday is Monday, 02 Jan 2006, time zone MST.")
 	systemPrompt = bytes.TrimSpace(systemPrompt)
 
-	userMessage := message{Role: "user"}
+	userMessage := message{Role: roles.user}
 
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	if args.stopFile != "" {
+		watchStopFile(ctx, args.stopFile, cancel)
+	}
 	handler := loadHandlers()
-	for _, name := range slices.Compact(args.attach) {
-		block, err := handler.attToBlock(ctx, name)
+	var images []string         // names of attachments, one per image
+	var entries []manifestEntry // for -manifest
+	for i, name := range slices.Compact(args.attach) {
+		opts := args.att
+		opts.index = i + 1
+		opts.bare = bareAttachment(args, prompt)
+		blocks, err := handler.attToBlock(ctx, name, opts)
 		if err != nil {
 			return err
 		}
-		switch b := block.(type) {
-		case *types.ContentBlockMemberText:
-			userMessage.Content = append(userMessage.Content, textBlock(b.Value))
-		case *types.ContentBlockMemberImage:
-			userMessage.Content = append(userMessage.Content, imageBlock(b.Value.Source.(*types.ImageSourceMemberBytes).Value))
-		default:
-			return fmt.Errorf("file %s is of unsupported type", name)
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry(name, blocks))
+		}
+		for _, block := range blocks {
+			switch b := block.(type) {
+			case *types.ContentBlockMemberText:
+				userMessage.Content = append(userMessage.Content, textBlock(b.Value))
+			case *types.ContentBlockMemberImage:
+				userMessage.Content = append(userMessage.Content, imageBlock(b.Value.Source.(*types.ImageSourceMemberBytes).Value))
+				images = append(images, name)
+			case *types.ContentBlockMemberAudio:
+				return fmt.Errorf("file %s is an audio file, model does not support audio", name)
+			case *types.ContentBlockMemberDocument:
+				// chat completions take no documents, but the ones in text
+				// formats can be inlined, the same way plain text files are
+				text, ok := documentText(name, b.Value, opts)
+				if !ok {
+					return fmt.Errorf("file %s is of unsupported type", name)
+				}
+				userMessage.Content = append(userMessage.Content, textBlock(text))
+			default:
+				return fmt.Errorf("file %s is of unsupported type", name)
+			}
+		}
+	}
+	if args.since != "" {
+		block, err := commandOutputBlock(ctx, args.since)
+		if err != nil {
+			return err
+		}
+		userMessage.Content = append(userMessage.Content, textBlock(block.(*types.ContentBlockMemberText).Value))
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("-since="+args.since, []types.ContentBlock{block}))
+		}
+	}
+	if args.sinceCommit != "" {
+		block, err := gitDiffBlock(ctx, args.sinceCommit)
+		if err != nil {
+			return err
+		}
+		userMessage.Content = append(userMessage.Content, textBlock(block.(*types.ContentBlockMemberText).Value))
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("-since-commit="+args.sinceCommit, []types.ContentBlock{block}))
+		}
+	}
+	if args.clipboardImage {
+		userMessage.Content = append(userMessage.Content, imageBlock(args.clipboard))
+		images = append(images, "clipboard")
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("clipboard", []types.ContentBlock{
+				&types.ContentBlockMemberImage{Value: types.ImageBlock{Format: types.ImageFormatPng, Source: &types.ImageSourceMemberBytes{Value: args.clipboard}}},
+			}))
+		}
+	}
+	if err := checkImageCount(images, args.maxImages); err != nil {
+		return err
+	}
+	if args.manifest != "" {
+		if err := writeManifest(args.manifest, args.requestID, entries); err != nil {
+			return err
 		}
 	}
-	userMessage.Content = append(userMessage.Content, textBlock(prompt))
+	if prompt != "" {
+		userMessage.Content = append(userMessage.Content, textBlock(prompt))
+	} else if len(userMessage.Content) != 1 || len(images) != 0 {
+		return errBareAttachment
+	}
+	examples, err := loadExamples(args.examples)
+	if err != nil {
+		return err
+	}
 
 	modelRequest := chatgptRequest{
-		Model:  cmp.Or(os.Getenv("LLMCLI_CHATGPT_MODEL"), "gpt-4o-2024-08-06"),
-		Stream: true,
+		Model:       args.config.chatgptModel(),
+		Stream:      !args.noStream,
+		Seed:        args.seed,
+		Logprobs:    args.logprobs != nil,
+		TopLogprobs: args.logprobs,
 		Messages: []message{
-			{Role: "system", Content: []contentEntry{textBlock(systemPrompt)}},
-			userMessage,
+			{Role: roles.system, Content: []contentEntry{textBlock(systemPrompt)}},
 		},
-		Temperature: args.t,
 	}
-	if args.v {
-		modelRequest.StreamOptions.IncludeUsage = true
+	if args.tools != "" {
+		b, err := os.ReadFile(args.tools)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(b) {
+			return fmt.Errorf("%s is not a valid json", args.tools)
+		}
+		modelRequest.Tools = b
 	}
-	payload, err := json.Marshal(modelRequest)
-	if err != nil {
-		return err
+	if args.noSystem {
+		modelRequest.Messages = nil
+	}
+	for _, ex := range examples {
+		modelRequest.Messages = append(modelRequest.Messages,
+			message{Role: roles.user, Content: []contentEntry{textBlock(ex.user)}},
+			message{Role: roles.assistant, Content: []contentEntry{textBlock(ex.assistant)}},
+		)
 	}
-	var userAgent string
-	if bi, ok := debug.ReadBuildInfo(); ok {
+	modelRequest.Messages = append(modelRequest.Messages, userMessage)
+	if (args.v || args.frontmatter) && modelRequest.Stream {
+		modelRequest.StreamOptions = &streamOptions{IncludeUsage: true}
+	}
+	if args.hashPrompt || args.v {
+		msgs := modelRequest.Messages
+		if !args.noSystem {
+			// the system message has the date, key has the prompt without it
+			msgs = msgs[1:]
+		}
+		key := &requestKey{Provider: "chatgpt", Model: modelRequest.Model, Messages: msgs, Seed: args.seed, Tools: modelRequest.Tools}
+		if key.Inference, err = inferenceConfig(args, modelRequest.Model, args.t); err != nil {
+			return err
+		}
+		if done, err := reportHash(args, key); done || err != nil {
+			return err
+		}
+	}
+	userAgent := os.Getenv("LLMCLI_USER_AGENT")
+	if bi, ok := debug.ReadBuildInfo(); ok && userAgent == "" {
 		userAgent = fmt.Sprintf("%s/%s", bi.Main.Path, bi.Main.Version)
 	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	var sent time.Time // when the last request was sent
 	fn := func() (*http.Response, error) {
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.openai.com/v1/chat/completions", bytes.NewReader(payload))
+		sent = time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.chatURL, bytes.NewReader(payload))
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range api.auth {
+			req.Header[k] = v
+		}
 		if userAgent != "" {
 			req.Header.Set("User-Agent", userAgent)
 		}
-		resp, err := http.DefaultClient.Do(req)
+		req.Header.Set("X-Client-Request-Id", args.requestID)
+		for k, v := range args.headers {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
 		if err != nil {
 			return nil, err
 		}
@@ -108,7 +354,7 @@ func chatgpt(ctx context.Context, args runArgs) error {
 		}
 		defer resp.Body.Close()
 		statusErr := &unexpectedStatusError{code: resp.StatusCode}
-		if resp.Header.Get("Content-Type") == "application/json" {
+		if mediaType(resp.Header) == "application/json" {
 			buf := make([]byte, 1024)
 			n, _ := io.ReadFull(resp.Body, buf)
 			if buf = buf[:n]; len(buf) != 0 {
@@ -117,51 +363,311 @@ func chatgpt(ctx context.Context, args runArgs) error {
 		}
 		return nil, statusErr
 	}
+	var retryErr error // the last error the request is retried on
 	rcfg := retry.Config{MaxAttempts: 3, RetryOn: func(err error) bool {
 		var e *unexpectedStatusError
-		return errors.As(err, &e) && e.code == http.StatusTooManyRequests
+		if errors.As(err, &e) && e.code == http.StatusTooManyRequests || transientNetError(err) {
+			retryErr = err
+			return true
+		}
+		return false
 	}}
-	rcfg = rcfg.WithDelayFunc(func(i int) time.Duration { return time.Second * time.Duration(i) })
-	resp, err := retry.FuncVal(ctx, rcfg, fn)
-	if err != nil {
+	rcfg = rcfg.WithDelayFunc(func(i int) time.Duration {
+		delay := time.Second * time.Duration(i)
+		if args.retryLog != nil {
+			args.retryLog.Printf("chatgpt: attempt %d failed, retrying in %v: %v", i, delay, retryErr)
+		}
+		return delay
+	})
+	// with -retry-truncated, the reply is held until it is complete, so
+	// that replies of repeated requests don't follow the cut off ones
+	var held bytes.Buffer
+	release := func() error {
+		if held.Len() == 0 {
+			return nil
+		}
+		_, err := args.out.Write(held.Bytes())
+		held.Reset()
 		return err
 	}
-	ct := resp.Header.Get("Content-Type")
-	if ct != "text/event-stream; charset=utf-8" {
-		return fmt.Errorf("unexpected content-type: %q", ct)
+	var out io.Writer = args.out
+	if args.retryTruncated {
+		out = &held
+	}
+	if args.format == "ndjson" {
+		out = newNdjsonWriter(out)
+	}
+	var buf bytes.Buffer
+	if args.convertReply() {
+		out = &buf
+	} else if len(args.sinks) != 0 {
+		if args.format == "ndjson" {
+			return errors.New("-md-file and -save are not supported with ndjson format")
+		}
+		out = io.MultiWriter(out, &buf)
+	}
+	var stats *textStats
+	if args.v {
+		stats = &textStats{}
+	}
+	var fingerprint *string
+	if args.v && args.seed != nil {
+		fingerprint = new(string)
+	}
+	var logprobs *[]tokenLogprob
+	if args.logprobs != nil {
+		logprobs = new([]tokenLogprob)
 	}
-	return streamResponse(resp.Body)
+	// ask sends request with the given temperature and writes reply
+	ask := func(temperature *float32) (*chatgptUsage, error) {
+		if logprobs != nil {
+			*logprobs = (*logprobs)[:0]
+		}
+		ic, err := inferenceConfig(args, modelRequest.Model, temperature)
+		if err != nil {
+			return nil, err
+		}
+		ic = cmp.Or(ic, &types.InferenceConfiguration{})
+		modelRequest.Temperature, modelRequest.MaxTokens, modelRequest.TopP = ic.Temperature, ic.MaxTokens, ic.TopP
+		modelRequest.Stop = ic.StopSequences
+		if api.responses {
+			payload, err = json.Marshal(modelRequest.responsesRequest())
+		} else {
+			payload, err = json.Marshal(modelRequest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp, err := retry.FuncVal(ctx, rcfg, fn)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		ct := mediaType(resp.Header)
+		if !modelRequest.Stream {
+			if ct != "application/json" {
+				return nil, fmt.Errorf("unexpected content-type: %q", resp.Header.Get("Content-Type"))
+			}
+			if api.responses {
+				return readResponsesReply(out, resp.Body, stats, &outputLimit{max: args.maxOutputBytes})
+			}
+			return readResponse(out, resp.Body, stats, fingerprint, logprobs, &outputLimit{max: args.maxOutputBytes})
+		}
+		if ct != "text/event-stream" {
+			return nil, fmt.Errorf("unexpected content-type: %q", resp.Header.Get("Content-Type"))
+		}
+		if api.responses {
+			return streamResponsesReply(out, resp.Body, stats, &outputLimit{max: args.maxOutputBytes})
+		}
+		return streamResponse(out, resp.Body, stats, fingerprint, logprobs, &outputLimit{max: args.maxOutputBytes})
+	}
+	if args.showModel || args.v {
+		// with Azure OpenAI, this is the deployment name
+		log.Printf("model: %s", modelRequest.Model)
+	}
+	temperatures := []*float32{args.t}
+	if len(args.tSweep) != 0 {
+		temperatures = temperatures[:0]
+		for i := range args.tSweep {
+			temperatures = append(temperatures, &args.tSweep[i])
+		}
+	}
+	var usage tokenUsage
+	var latencies []latency
+	for i, t := range temperatures {
+		if len(args.tSweep) != 0 {
+			if i != 0 {
+				io.WriteString(out, "\n")
+			}
+			fmt.Fprintf(out, "## Temperature %g\n\n", *t)
+		}
+		if stats != nil {
+			stats.first = time.Time{}
+		}
+		paused := pausedFor(args.out)
+		bufLen, heldLen := buf.Len(), held.Len()
+		var saved textStats
+		if stats != nil {
+			saved = *stats
+		}
+		var u *chatgptUsage
+		var err error
+		for attempt := 0; ; attempt++ {
+			u, err = ask(t)
+			if u != nil {
+				usage.add(u.Input, u.Output, u.Total)
+			}
+			if !args.retryTruncated || attempt == 2 || !errors.Is(err, errTruncated) {
+				break
+			}
+			log.Printf("reply stream was cut off, retrying the request: %v", err)
+			// only the complete reply must be printed, converted, or saved
+			buf.Truncate(bufLen)
+			held.Truncate(heldLen)
+			if stats != nil {
+				*stats = saved
+			}
+		}
+		if err2 := release(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			if stats != nil {
+				// describe the part of the reply received before the failure
+				log.Print(stats.String())
+			}
+			return err
+		}
+		if stats != nil {
+			var outputTokens int
+			if u != nil {
+				outputTokens = u.Output
+			}
+			latencies = append(latencies, newLatency(sent, stats.first, pausedFor(args.out)-paused, outputTokens))
+		}
+		if fingerprint != nil && *fingerprint != "" {
+			log.Printf("system fingerprint: %s", *fingerprint)
+		}
+		if logprobs != nil {
+			if err := writeLogprobs(os.Stderr, *logprobs); err != nil {
+				return err
+			}
+		}
+	}
+	if args.v && usage.seen {
+		log.Printf("tokens usage: total: %d, input: %d, output: %d", usage.total, usage.input, usage.output)
+	}
+	for _, l := range latencies {
+		log.Print(l)
+	}
+	if stats != nil {
+		log.Print(stats.String())
+	}
+	if args.summary {
+		logSummary([]string{modelRequest.Model}, started)
+	}
+	if args.footer != "" {
+		fmt.Fprintf(out, "\n%s\n", footerText(args.footer, modelRequest.Model, time.Now()))
+		if err := release(); err != nil {
+			return err
+		}
+	}
+	if len(args.sinks) != 0 {
+		var info *replyInfo
+		if args.frontmatter {
+			info = &replyInfo{model: modelRequest.Model, time: time.Now(), prompt: prompt, usage: usage}
+		}
+		if err := saveSinks(buf.Bytes(), args, info); err != nil {
+			return err
+		}
+	}
+	if args.template != nil {
+		return writeTemplate(args.out, args.template, buf.String(), modelRequest.Model, usage)
+	}
+	if args.convertReply() {
+		return writeConverted(args.out, buf.String(), args)
+	}
+	return nil
+}
+
+// readResponse handles reply to non-streaming request. If stats is not nil,
+// it is fed with the text of reply. If fingerprint is not nil, it is set to the
+// system fingerprint of the backend that produced the reply. If logprobs is
+// not nil, it is set to log probabilities of the reply tokens. Reply is
+// truncated to fit within limit.
+func readResponse(out io.Writer, r io.Reader, stats *textStats, fingerprint *string, logprobs *[]tokenLogprob, limit *outputLimit) (*chatgptUsage, error) {
+	var msg chatgptResponse
+	if err := json.NewDecoder(r).Decode(&msg); err != nil {
+		return nil, err
+	}
+	if fingerprint != nil {
+		*fingerprint = msg.Fingerprint
+	}
+	if len(msg.Choices) == 0 {
+		return msg.Usage, errors.New("empty response")
+	}
+	if logprobs != nil && msg.Choices[0].Logprobs != nil {
+		*logprobs = msg.Choices[0].Logprobs.Content
+	}
+	var err error
+	if text, ok := limit.take(msg.Choices[0].Message.Content); !ok {
+		msg.Choices[0].Message.Content = text
+		err = errOutputLimit
+	}
+	if stats != nil {
+		stats.WriteString(msg.Choices[0].Message.Content)
+	}
+	if reason := msg.Choices[0].Reason; reason != "stop" && err == nil {
+		switch reason {
+		case "tool_calls":
+			logToolCalls(msg.Choices[0].Message.ToolCalls)
+		case "content_filter":
+			err = &contentFilterError{stopReason: reason}
+		}
+		if err == nil {
+			err = fmt.Errorf("stop reason: %s", reason)
+		}
+	}
+	if nd, ok := out.(*ndjsonWriter); ok {
+		nd.WriteString(msg.Choices[0].Message.Content)
+		if err2 := nd.finish(msg.Choices[0].Reason, msg.Usage.ndjson(), err); err == nil {
+			err = err2
+		}
+		return msg.Usage, err
+	}
+	if _, err := io.WriteString(out, msg.Choices[0].Message.Content+"\n"); err != nil {
+		return msg.Usage, err
+	}
+	return msg.Usage, err
 }
 
-func streamResponse(r io.Reader) error {
+// streamResponse handles reply to streaming request. If stats is not nil,
+// it is fed with the text of reply. If fingerprint is not nil, it is set to the
+// system fingerprint of the backend that produced the reply. If logprobs is
+// not nil, log probabilities of the reply tokens are appended to it. Once
+// reply exceeds limit, it stops reading it and returns errOutputLimit.
+func streamResponse(out io.Writer, r io.Reader, stats *textStats, fingerprint *string, logprobs *[]tokenLogprob, limit *outputLimit) (tokenUsage *chatgptUsage, err error) {
 	// https://platform.openai.com/docs/api-reference/chat/object
 	// https://platform.openai.com/docs/api-reference/streaming
-	type usage struct {
-		Total  int `json:"total_tokens"`
-		Input  int `json:"prompt_tokens"`
-		Output int `json:"completion_tokens"`
-	}
-	var tokenUsage *usage
+	var stopReason string
+	var toolCalls []chatgptToolCall
+	nd, _ := out.(*ndjsonWriter)
 	defer func() {
-		if tokenUsage == nil {
-			return
+		if nd != nil {
+			if err2 := nd.finish(stopReason, tokenUsage.ndjson(), err); err == nil {
+				err = err2
+			}
 		}
-		log.Printf("tokens usage: total: %d, input: %d, output: %d", tokenUsage.Total, tokenUsage.Input, tokenUsage.Output)
 	}()
 	type chunk struct {
-		Otype   string `json:"object"`
-		Choices []struct {
+		Otype       string `json:"object"`
+		Fingerprint string `json:"system_fingerprint"`
+		Choices     []struct {
 			Delta struct {
-				Content string  `json:"content"`
-				Reason  *string `json:"finish_reason"`
+				Content   string            `json:"content"`
+				ToolCalls []chatgptToolCall `json:"tool_calls"`
 			} `json:"delta"`
+			Logprobs *choiceLogprobs `json:"logprobs"`
+			Reason   *string         `json:"finish_reason"`
 		} `json:"choices"`
-		Usage *usage `json:"usage"`
+		Usage *chatgptUsage `json:"usage"`
+	}
+	var w interface {
+		io.StringWriter
+		Flush() error
+	} = bufio.NewWriterSize(out, 4096)
+	if nd != nil {
+		w = nd
 	}
-	w := bufio.NewWriterSize(os.Stdout, 40)
 	defer w.Flush()
-	sc := bufio.NewScanner(r)
+	fr := &flushingReader{r: r, w: w}
+	sc := bufio.NewScanner(fr)
+	// a single delta may be larger than the default 64KiB line limit
+	sc.Buffer(nil, maxDocumentSize)
 	for sc.Scan() {
+		if fr.err != nil {
+			return tokenUsage, fr.err
+		}
 		const dataPrefix = "data: "
 		const doneChunk = "data: [DONE]"
 		b := sc.Bytes()
@@ -169,38 +675,260 @@ func streamResponse(r io.Reader) error {
 			continue
 		}
 		if len(b) == len(doneChunk) && string(b) == doneChunk {
-			w.WriteByte('\n')
-			break
+			if nd == nil {
+				w.WriteString("\n")
+			}
+			return tokenUsage, w.Flush()
 		}
 		var msg chunk
 		if err := json.Unmarshal(b[len(dataPrefix):], &msg); err != nil {
-			return err
+			return tokenUsage, err
 		}
 		if msg.Usage != nil && tokenUsage == nil {
 			tokenUsage = msg.Usage
 		}
+		if fingerprint != nil && msg.Fingerprint != "" {
+			*fingerprint = msg.Fingerprint
+		}
 		if msg.Otype != "chat.completion.chunk" || len(msg.Choices) == 0 {
 			continue
 		}
-		w.WriteString(msg.Choices[0].Delta.Content)
-		if reason := msg.Choices[0].Delta.Reason; reason != nil && *reason != "stop" {
-			return fmt.Errorf("stop reason: %s", *reason)
+		if logprobs != nil && msg.Choices[0].Logprobs != nil {
+			*logprobs = append(*logprobs, msg.Choices[0].Logprobs.Content...)
 		}
+		text, ok := limit.take(msg.Choices[0].Delta.Content)
+		if _, err := w.WriteString(text); err != nil {
+			return tokenUsage, err
+		}
+		if stats != nil {
+			stats.WriteString(text)
+		}
+		if !ok {
+			if nd == nil {
+				w.WriteString("\n")
+			}
+			return tokenUsage, errOutputLimit
+		}
+		for _, tc := range msg.Choices[0].Delta.ToolCalls {
+			// the first delta of each call carries its id and name,
+			// the following ones only carry pieces of arguments
+			if tc.Index < len(toolCalls) {
+				toolCalls[tc.Index].Function.Arguments += tc.Function.Arguments
+			} else {
+				toolCalls = append(toolCalls, tc)
+			}
+		}
+		if reason := msg.Choices[0].Reason; reason != nil {
+			if stopReason = *reason; stopReason == "tool_calls" {
+				logToolCalls(toolCalls)
+			}
+			if stopReason == "content_filter" {
+				return tokenUsage, &contentFilterError{stopReason: stopReason}
+			}
+			if stopReason != "stop" {
+				return tokenUsage, fmt.Errorf("stop reason: %s", stopReason)
+			}
+		}
+	}
+	if nd == nil {
+		w.WriteString("\n")
+	}
+	if fr.err != nil {
+		return tokenUsage, fr.err
 	}
 	if err := sc.Err(); err != nil {
+		return tokenUsage, streamError(err)
+	}
+	return tokenUsage, errTruncated
+}
+
+// streamError returns the error of reading reply stream. Read errors, like an
+// unexpected EOF, cut the reply off, so they are reported as errTruncated.
+func streamError(err error) error {
+	if errors.Is(err, bufio.ErrTooLong) {
 		return err
 	}
-	return w.Flush()
+	return fmt.Errorf("%w: %w", errTruncated, err)
+}
+
+// flushingReader flushes w before each read from r, so that the reply
+// decoded from the data received so far is shown before waiting for more of
+// it, without a write per delta. If the flush fails, err is set and reads
+// stop.
+type flushingReader struct {
+	r   io.Reader
+	w   interface{ Flush() error }
+	err error
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	if f.err = f.w.Flush(); f.err != nil {
+		return 0, f.err
+	}
+	return f.r.Read(p)
+}
+
+// errTruncated is returned when reply stream ends without its final event,
+// which is usually caused by dropped connection.
+var errTruncated = errors.New("reply stream ended unexpectedly, the reply may be incomplete")
+
+// chatgptToolCall is model's request to call a function, see
+// https://platform.openai.com/docs/api-reference/chat/object
+type chatgptToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // json-encoded
+	} `json:"function"`
+}
+
+func logToolCalls(calls []chatgptToolCall) {
+	for _, tc := range calls {
+		log.Printf("model requested to use tool %s (id %s) with arguments: %s", tc.Function.Name, tc.ID, tc.Function.Arguments)
+	}
+}
+
+// documentText returns the document in a text format, like html, wrapped
+// within tags, the same as plain text attachments inlined into the prompt. It
+// returns false if the document is not a valid utf8 text.
+func documentText(name string, doc types.DocumentBlock, opts blockOptions) (string, bool) {
+	switch doc.Format {
+	case types.DocumentFormatHtml, types.DocumentFormatMd, types.DocumentFormatTxt, types.DocumentFormatCsv:
+	default:
+		return "", false
+	}
+	src, ok := doc.Source.(*types.DocumentSourceMemberBytes)
+	if !ok || !utf8.Valid(src.Value) {
+		return "", false
+	}
+	return string(appendDocument(nil, opts.docTag(doc.Format), opts.docAttrs(), filepath.Base(name), src.Value)), true
+}
+
+// mediaType returns the media type of the Content-Type header, without its
+// parameters, like charset.
+func mediaType(h http.Header) string {
+	mt, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return h.Get("Content-Type")
+	}
+	return mt
+}
+
+// httpClient returns client to make OpenAI API requests with, configured by
+// LLMCLI_HTTP_PROXY (proxy url) and LLMCLI_HTTP_TIMEOUT (time limit for the
+// whole request, including reading the reply) environment variables.
+func httpClient() (*http.Client, error) {
+	proxy, timeout := os.Getenv("LLMCLI_HTTP_PROXY"), os.Getenv("LLMCLI_HTTP_TIMEOUT")
+	if proxy == "" && timeout == "" {
+		return http.DefaultClient, nil
+	}
+	client := &http.Client{}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("LLMCLI_HTTP_PROXY must be an absolute url, got %q", proxy)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = http.ProxyURL(u)
+		client.Transport = tr
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("LLMCLI_HTTP_TIMEOUT must be a non-negative duration like 90s, got %q", timeout)
+		}
+		client.Timeout = d
+	}
+	return client, nil
+}
+
+// parseHeader parses http header given in the "Name: Value" form.
+func parseHeader(s string) (name, value string, err error) {
+	name, value, ok := strings.Cut(s, ":")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("header %q is not in the \"Name: Value\" form", s)
+	}
+	if i := strings.IndexFunc(name, func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+	}); i >= 0 {
+		return "", "", fmt.Errorf("header name %q has invalid character %q", name, name[i])
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return "", "", fmt.Errorf("header %s value has line breaks", name)
+	}
+	return name, value, nil
+}
+
+// chatRoleNames are the role names of chat completions messages.
+type chatRoleNames struct {
+	system, user, assistant string
+}
+
+var defaultChatRoles = chatRoleNames{system: "system", user: "user", assistant: "assistant"}
+
+// chatRoles returns the role names to use in chat completions messages.
+// Some OpenAI-compatible servers expect different ones, like "model" instead
+// of "assistant", and LLMCLI_OPENAI_SYSTEM_ROLE, LLMCLI_OPENAI_USER_ROLE, and
+// LLMCLI_OPENAI_ASSISTANT_ROLE override the defaults.
+func chatRoles() chatRoleNames {
+	return chatRoleNames{
+		system:    cmp.Or(os.Getenv("LLMCLI_OPENAI_SYSTEM_ROLE"), defaultChatRoles.system),
+		user:      cmp.Or(os.Getenv("LLMCLI_OPENAI_USER_ROLE"), defaultChatRoles.user),
+		assistant: cmp.Or(os.Getenv("LLMCLI_OPENAI_ASSISTANT_ROLE"), defaultChatRoles.assistant),
+	}
+}
+
+func (c *fileConfig) chatgptModel() string {
+	return cmp.Or(configEnv("LLMCLI_CHATGPT_MODEL", c.ChatgptModel), "gpt-4o-2024-08-06")
 }
 
 type chatgptRequest struct {
-	Model         string    `json:"model"`
-	Stream        bool      `json:"stream"`
-	Messages      []message `json:"messages"`
-	Temperature   *float32  `json:"temperature,omitempty"`
-	StreamOptions struct {
-		IncludeUsage bool `json:"include_usage"`
-	} `json:"stream_options"`
+	Model         string          `json:"model"`
+	Stream        bool            `json:"stream"`
+	Messages      []message       `json:"messages"`
+	Temperature   *float32        `json:"temperature,omitempty"`
+	MaxTokens     *int32          `json:"max_completion_tokens,omitempty"`
+	TopP          *float32        `json:"top_p,omitempty"`
+	Stop          []string        `json:"stop,omitempty"`
+	Seed          *int64          `json:"seed,omitempty"`
+	Logprobs      bool            `json:"logprobs,omitempty"`
+	TopLogprobs   *int            `json:"top_logprobs,omitempty"`
+	Tools         json.RawMessage `json:"tools,omitempty"`
+	StreamOptions *streamOptions  `json:"stream_options,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatgptResponse is a reply to non-streaming request,
+// see https://platform.openai.com/docs/api-reference/chat/object
+type chatgptResponse struct {
+	Choices []struct {
+		Message struct {
+			Content   string            `json:"content"`
+			ToolCalls []chatgptToolCall `json:"tool_calls"`
+		} `json:"message"`
+		Logprobs *choiceLogprobs `json:"logprobs"`
+		Reason   string          `json:"finish_reason"`
+	} `json:"choices"`
+	Usage       *chatgptUsage `json:"usage"`
+	Fingerprint string        `json:"system_fingerprint"`
+}
+
+type chatgptUsage struct {
+	Total  int `json:"total_tokens"`
+	Input  int `json:"prompt_tokens"`
+	Output int `json:"completion_tokens"`
+}
+
+func (u *chatgptUsage) ndjson() *ndjsonUsage {
+	if u == nil {
+		return nil
+	}
+	return &ndjsonUsage{Input: u.Input, Output: u.Output, Total: u.Total}
 }
 
 type message struct {
@@ -236,16 +964,25 @@ func (t textBlock) MarshalJSON() ([]byte, error) {
 
 type imageBlock []byte
 
-func (img imageBlock) MarshalJSON() ([]byte, error) {
-	var out []byte
-	out = append(out, `{"type":"image_url","image_url":{"url":"data:`...)
+// appendDataURL appends image img encoded as a data: url to dst.
+func appendDataURL(dst, img []byte) ([]byte, error) {
 	ct := http.DetectContentType(img)
 	if !strings.HasPrefix(ct, "image/") {
-		return nil, fmt.Errorf("detected non-image content type for imageBlock: %s", ct)
+		return nil, fmt.Errorf("detected non-image content type: %s", ct)
+	}
+	dst = append(dst, "data:"...)
+	dst = append(dst, ct...)
+	dst = append(dst, ";base64,"...)
+	return base64.StdEncoding.AppendEncode(dst, img), nil
+}
+
+func (img imageBlock) MarshalJSON() ([]byte, error) {
+	var out []byte
+	out = append(out, `{"type":"image_url","image_url":{"url":"`...)
+	out, err := appendDataURL(out, img)
+	if err != nil {
+		return nil, fmt.Errorf("imageBlock: %w", err)
 	}
-	out = append(out, ct...)
-	out = append(out, `;base64,`...)
-	out = base64.StdEncoding.AppendEncode(out, img)
 	out = append(out, `"}}`...)
 	if !json.Valid(out) {
 		panic("produced invalid json")
@@ -253,6 +990,30 @@ func (img imageBlock) MarshalJSON() ([]byte, error) {
 	return out, nil
 }
 
+// transientNetError reports whether err is a network error that may go away
+// on its own: a timeout, a temporary DNS lookup failure, or a refused or reset
+// connection. Canceled requests and names that don't resolve are not
+// considered transient.
+//
+// A connection may be reset after the request was sent and received, so a
+// retry may send the same request twice. That is intended: requests carry the
+// whole conversation and aren't stored server-side, so the only cost of a
+// duplicate is the tokens it uses.
+func transientNetError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return de.IsTemporary || de.IsTimeout
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
 type unexpectedStatusError struct {
 	code int
 	text string
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// sseStream returns chat completions reply stream with the given deltas.
+func sseStream(tb testing.TB, deltas ...string) string {
+	var chunks []any
+	for _, d := range deltas {
+		chunks = append(chunks, map[string]any{"object": "chat.completion.chunk", "choices": []any{map[string]any{"delta": map[string]any{"content": d}}}})
+	}
+	chunks = append(chunks, map[string]any{"object": "chat.completion.chunk", "choices": []any{map[string]any{"delta": map[string]any{}, "finish_reason": "stop"}}})
+	var sse strings.Builder
+	for _, chunk := range chunks {
+		b, err := json.Marshal(chunk)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		sse.WriteString("data: ")
+		sse.Write(b)
+		sse.WriteString("\n\n")
+	}
+	sse.WriteString("data: [DONE]\n\n")
+	return sse.String()
+}
+
+func TestStreamResponseLongLine(t *testing.T) {
+	text := strings.Repeat("long reply ", 10_000) // over bufio.Scanner's default 64KB
+	sse := sseStream(t, text)
+	if len(sse) <= 64<<10 {
+		t.Fatalf("test stream is only %d bytes long", len(sse))
+	}
+	var out strings.Builder
+	if _, err := streamResponse(&out, strings.NewReader(sse), nil, nil, nil, &outputLimit{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), text+"\n"; got != want {
+		t.Fatalf("got %d bytes of reply, want %d", len(got), len(want))
+	}
+}
+
+// countingWriter counts calls to its Write method.
+type countingWriter struct{ writes int }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+// BenchmarkStreamResponse reports how many writes to the output a reply of
+// many small deltas takes, compared to flushing the output after each delta.
+func BenchmarkStreamResponse(b *testing.B) {
+	deltas := strings.Fields(strings.Repeat("a reply of many short deltas ", 500))
+	sse := sseStream(b, deltas...)
+	b.Run("flush-per-delta", func(b *testing.B) {
+		var cw countingWriter
+		for b.Loop() {
+			w := bufio.NewWriterSize(&cw, 4096)
+			for _, d := range deltas {
+				w.WriteString(d)
+				w.Flush()
+			}
+		}
+		b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+	})
+	b.Run("flush-before-read", func(b *testing.B) {
+		var cw countingWriter
+		for b.Loop() {
+			if _, err := streamResponse(&cw, strings.NewReader(sse), nil, nil, nil, &outputLimit{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(cw.writes)/float64(b.N), "writes/op")
+	})
+}
+
+func TestParseHeader(t *testing.T) {
+	for _, tc := range []struct {
+		in          string
+		name, value string
+		ok          bool
+	}{
+		{in: "X-Team: billing", name: "X-Team", value: "billing", ok: true},
+		{in: "  X-Team:billing  ", name: "X-Team", value: "billing", ok: true},
+		{in: "X-Empty:", name: "X-Empty", ok: true},
+		{in: "X-Url: https://example.com:8080/", name: "X-Url", value: "https://example.com:8080/", ok: true},
+		{in: "no colon"},
+		{in: ": value"},
+		{in: "X Team: billing"},
+		{in: "X-Téam: billing"},
+		{in: "X-Team: a\r\nX-Other: b"},
+	} {
+		name, value, err := parseHeader(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("parseHeader(%q) error: %v, want error: %v", tc.in, err, !tc.ok)
+			continue
+		}
+		if name != tc.name || value != tc.value {
+			t.Errorf("parseHeader(%q) = %q, %q, want %q, %q", tc.in, name, value, tc.name, tc.value)
+		}
+	}
+}
+
+func TestStreamResponseWriteError(t *testing.T) {
+	sse := sseStream(t, strings.Fields(strings.Repeat("a reply of many short deltas ", 500))...)
+	_, err := streamResponse(errWriter{}, strings.NewReader(sse), nil, nil, nil, &outputLimit{})
+	if !errors.Is(err, errClosedOutput) {
+		t.Fatalf("got error %v, want %v", err, errClosedOutput)
+	}
+}
+
+var errClosedOutput = errors.New("output closed")
+
+// errWriter fails every write with errClosedOutput.
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errClosedOutput }
+
+func TestTransientNetError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}},
+		{err: &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}, want: true},
+		{err: &net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}, want: true},
+		{err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, want: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, want: true},
+		{err: context.Canceled},
+		{err: errors.New("some error")},
+	} {
+		if got := transientNetError(tc.err); got != tc.want {
+			t.Errorf("transientNetError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
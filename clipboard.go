@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// writeClipboard replaces the contents of the system clipboard with text b.
+func writeClipboard(b []byte) error {
+	run := func(name string, args ...string) error {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = bytes.NewReader(b)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("writing clipboard with %v: %w", cmd, err)
+		}
+		return nil
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return run("pbcopy")
+	case "windows":
+		return run("powershell.exe", "-NoProfile", "-Command",
+			"[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())")
+	}
+	if _, err := exec.LookPath("wl-copy"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+		return run("wl-copy")
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return run("xclip", "-selection", "clipboard", "-i")
+	}
+	return errors.New("no clipboard tool found, install either wl-clipboard or xclip")
+}
+
+// readClipboard returns the contents of the system clipboard, and whether it
+// holds an image (only detected with wl-paste and xclip).
+func readClipboard() ([]byte, bool, error) {
+	run := func(name string, args ...string) ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("reading clipboard with %v: %w", cmd, err)
+		}
+		return b, nil
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		b, err := run("pbpaste")
+		return b, false, err
+	case "windows":
+		b, err := run("powershell.exe", "-NoProfile", "-Command",
+			"[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw")
+		return b, false, err
+	}
+	if _, err := exec.LookPath("wl-paste"); err == nil && os.Getenv("WAYLAND_DISPLAY") != "" {
+		types, err := run("wl-paste", "--list-types")
+		if err != nil {
+			return nil, false, err
+		}
+		if slices.Contains(strings.Fields(string(types)), "image/png") {
+			b, err := run("wl-paste", "--type", "image/png")
+			return b, true, err
+		}
+		b, err := run("wl-paste", "--no-newline")
+		return b, false, err
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		targets, err := run("xclip", "-selection", "clipboard", "-t", "TARGETS", "-o")
+		if err != nil {
+			return nil, false, err
+		}
+		if slices.Contains(strings.Fields(string(targets)), "image/png") {
+			b, err := run("xclip", "-selection", "clipboard", "-t", "image/png", "-o")
+			return b, true, err
+		}
+		b, err := run("xclip", "-selection", "clipboard", "-o")
+		return b, false, err
+	}
+	return nil, false, errors.New("no clipboard tool found, install either wl-clipboard or xclip")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// fileConfig holds settings from the config.json file in the llmcli config
+// directory. Most of them are defaults for environment variables, and only
+// take effect if those variables are not set.
+type fileConfig struct {
+	Provider     string   `json:"provider"`      // LLMCLI_PROVIDER
+	Model        string   `json:"model"`         // LLMCLI_MODEL
+	ModelChain   []string `json:"model_chain"`   // LLMCLI_MODEL_CHAIN
+	ChatgptModel string   `json:"chatgpt_model"` // LLMCLI_CHATGPT_MODEL
+	SystemPrompt string   `json:"system_prompt"` // LLMCLI_SYSTEM_PROMPT
+	OnThrottle   string   `json:"on_throttle"`   // LLMCLI_ON_THROTTLE
+
+	// Temperature is used when neither flags nor LLMCLI_TEMPERATURE set
+	// it, and the model has no temperature of its own in Models.
+	Temperature *float32 `json:"temperature"`
+	// Models holds inference parameters keyed by model id or alias
+	Models map[string]modelDefaults `json:"models"`
+	// Routes pick Bedrock model by the estimated size of the request
+	Routes []modelRoute `json:"routes"`
+	// DocumentTags maps formats of text attachments inlined into the
+	// prompt to the tags to wrap them with instead of <document>
+	DocumentTags map[types.DocumentFormat]string `json:"document_tags"`
+}
+
+// modelRoute selects model for requests of at least MinInputTokens
+// estimated input tokens.
+type modelRoute struct {
+	MinInputTokens int    `json:"min_input_tokens"`
+	Model          string `json:"model"`
+}
+
+// routeModel returns the model of the route with the largest threshold that
+// inputTokens reaches, and whether there is such route.
+func (c *fileConfig) routeModel(inputTokens int) (string, bool) {
+	var best *modelRoute
+	for i, r := range c.Routes {
+		if inputTokens >= r.MinInputTokens && (best == nil || r.MinInputTokens >= best.MinInputTokens) {
+			best = &c.Routes[i]
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return modelAlias(best.Model), true
+}
+
+// modelDefaults are inference parameters to use with a particular model,
+// unless overridden by flags.
+type modelDefaults struct {
+	Temperature *float32 `json:"temperature"`
+	MaxTokens   *int32   `json:"max_tokens"`
+	TopP        *float32 `json:"top_p"`
+}
+
+// modelDefaults returns inference parameters for the model, falling back to
+// the top-level temperature. Parameters keyed by the exact model id take
+// precedence over the ones keyed by its alias.
+func (c *fileConfig) modelDefaults(model string) modelDefaults {
+	d, ok := c.Models[model]
+	if !ok {
+		for k, v := range c.Models {
+			if modelAlias(k) == model {
+				d = v
+				break
+			}
+		}
+	}
+	if d.Temperature == nil {
+		d.Temperature = c.Temperature
+	}
+	return d
+}
+
+// loadConfigFile reads config.json from the llmcli config directory, if it
+// exists. Settings that have an environment variable counterpart are resolved
+// with configEnv where they are used, so that flags and environment variables
+// take precedence over the file, and the file takes precedence over the
+// built-in defaults.
+func loadConfigFile() (fileConfig, error) {
+	var cfg fileConfig
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return cfg, nil
+	}
+	name := filepath.Join(configDir, "llmcli", "config.json")
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", name, err)
+	}
+	switch cfg.Provider {
+	case "", "bedrock", "chatgpt":
+	default:
+		return cfg, fmt.Errorf("%s: provider must be either bedrock or chatgpt", name)
+	}
+	validTemperature := func(t *float32) bool { return t == nil || *t >= 0 && *t <= 1 }
+	if !validTemperature(cfg.Temperature) {
+		return cfg, fmt.Errorf("%s: temperature must be within [0, 1] range", name)
+	}
+	for _, r := range cfg.Routes {
+		if r.Model == "" {
+			return cfg, fmt.Errorf("%s: each route must have a model", name)
+		}
+	}
+	for model, d := range cfg.Models {
+		if !validTemperature(d.Temperature) {
+			return cfg, fmt.Errorf("%s: temperature for %s must be within [0, 1] range", name, model)
+		}
+	}
+	for format, tag := range cfg.DocumentTags {
+		switch format {
+		case types.DocumentFormatMd, types.DocumentFormatTxt, types.DocumentFormatCsv:
+		default:
+			return cfg, fmt.Errorf("%s: document_tags only apply to md, txt, and csv formats, not %q", name, format)
+		}
+		if !validTagName(tag) {
+			return cfg, fmt.Errorf("%s: %q is not a valid tag name", name, tag)
+		}
+	}
+	return cfg, nil
+}
+
+// validTagName reports whether s can be used as a name of XML-like tag:
+// ASCII letters, digits, underscores, hyphens, and dots, starting with a
+// letter or underscore.
+func validTagName(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case i > 0 && (r >= '0' && r <= '9' || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// userSystemPrompt returns the system prompt to send, without the date line.
+// The first of these that is set takes effect:
+//
+//   - the built-in prompt of -polish
+//   - text of the -S flag
+//   - file of the -s flag
+//   - file from LLMCLI_SYSTEM_PROMPT environment variable
+//   - file from system_prompt of the config file
+//   - system-prompt.txt file in the llmcli config directory
+//
+// The environment variable comes before the config file, as it does for other
+// settings. The last four are resolved into args.sys by the time of the call,
+// and a missing or unreadable file counts as no prompt. Texts of
+// -system-append are then added to the end of it. It returns nil if there's no
+// usable prompt.
+func userSystemPrompt(args runArgs) []byte {
+	var b []byte
+	switch {
+	case args.polish != "":
+		b = []byte(polishSystemPrompt)
+	case args.sysText != "":
+		b = []byte(args.sysText)
+	case args.sys != "":
+		if data, err := os.ReadFile(args.sys); err == nil && utf8.Valid(data) {
+			b = bytes.TrimSpace(data)
+		}
+	}
+	for _, s := range args.sysAppend {
+		if len(b) != 0 {
+			b = append(b, "\n\n"...)
+		}
+		b = append(b, s...)
+	}
+	if b = bytes.TrimSpace(b); len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// configEnv returns the value of the environment variable key if it is set,
+// and value, the counterpart setting from the config file, otherwise.
+func configEnv(key, value string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return value
+}
+
+// useChatgpt reports whether requests should go to OpenAI instead of Bedrock:
+// either when the program is called as "chatgpt", or when LLMCLI_PROVIDER, or
+// provider of the config file, is set to "chatgpt".
+func (c *fileConfig) useChatgpt() bool {
+	return filepath.Base(os.Args[0]) == "chatgpt" || configEnv("LLMCLI_PROVIDER", c.Provider) == "chatgpt"
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestValidTagName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"document", true},
+		{"_data", true},
+		{"my-notes.v2", true},
+		{"A1", true},
+		{"", false},
+		{"1st", false},
+		{"-x", false},
+		{".x", false},
+		{"a b", false},
+		{"a>b", false},
+		{"ноты", false},
+	} {
+		if got := validTagName(tc.name); got != tc.want {
+			t.Errorf("validTagName(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
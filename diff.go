@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffSide is one of the two configurations -diff compares. Empty model or
+// nil temperature mean the defaults.
+type diffSide struct {
+	model string
+	t     *float32
+}
+
+func (d diffSide) String() string {
+	if d.t == nil {
+		return d.model
+	}
+	return fmt.Sprintf("%s, temperature %g", d.model, *d.t)
+}
+
+// parseDiffSide parses either a temperature or a model id.
+func parseDiffSide(s string) (diffSide, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return diffSide{}, errors.New("empty model id or temperature")
+	}
+	if t, err := parseTemperature(s); err == nil {
+		return diffSide{t: &t}, nil
+	}
+	return diffSide{model: modelAlias(s)}, nil
+}
+
+// diffOp is a single line of diff: kind is ' ' for the line common to both
+// texts, '-' for the line only in the first one, and '+' for the line only in
+// the second one.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit script turning a into b, based on their
+// longest common subsequence.
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes the difference between texts a and b named nameA
+// and nameB to w in unified format, with 3 lines of context. It writes
+// nothing if texts are the same, and reports whether they differ.
+func writeUnifiedDiff(w io.Writer, nameA, nameB, a, b string) (bool, error) {
+	const context = 3
+	ops := diffLines(splitLines(a), splitLines(b))
+	// numbers of lines of a and b preceding each op
+	aNum := make([]int, len(ops)+1)
+	bNum := make([]int, len(ops)+1)
+	for k, op := range ops {
+		aNum[k+1], bNum[k+1] = aNum[k], bNum[k]
+		if op.kind != '+' {
+			aNum[k+1]++
+		}
+		if op.kind != '-' {
+			bNum[k+1]++
+		}
+	}
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		end := i + 1 // past the last change of the hunk
+		// changes separated by up to 2*context common lines share a hunk
+		for j := i; j < len(ops) && j <= end+2*context; j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			}
+		}
+		start, stop := max(i-context, 0), min(end+context, len(ops))
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n",
+			hunkRange(aNum[start], aNum[stop]-aNum[start]),
+			hunkRange(bNum[start], bNum[stop]-bNum[start]))
+		for _, op := range ops[start:stop] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		i = stop
+	}
+	if sb.Len() == 0 {
+		return false, nil
+	}
+	_, err := io.WriteString(w, sb.String())
+	return true, err
+}
+
+// hunkRange formats range of count lines following the first lines of text
+// for the hunk header.
+func hunkRange(first, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", first)
+	}
+	return fmt.Sprintf("%d,%d", first+1, count)
+}
+
+func splitLines(s string) []string {
+	if s = strings.TrimSuffix(s, "\n"); s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
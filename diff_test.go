@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want string // ops, one per line
+	}{
+		{"", "", ""},
+		{"", "x", "+x"},
+		{"x", "", "-x"},
+		{"a b c", "a b c", " a; b; c"},
+		{"a b c", "a x c", " a;-b;+x; c"},
+		{"a b c", "b c d", "-a; b; c;+d"},
+	} {
+		var got []string
+		for _, op := range diffLines(strings.Fields(tc.a), strings.Fields(tc.b)) {
+			got = append(got, string(op.kind)+op.line)
+		}
+		if s := strings.Join(got, ";"); s != tc.want {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tc.a, tc.b, s, tc.want)
+		}
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			b.WriteString(strings.Repeat("l", i))
+			b.WriteByte('\n')
+		}
+		return b.String()
+	}
+	for _, tc := range []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{name: "same", a: "a\nb\n", b: "a\nb\n"},
+		{name: "both empty"},
+		{
+			name: "from empty",
+			b:    "a\nb\n",
+			want: "--- A\n+++ B\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "to empty",
+			a:    "a\n",
+			want: "--- A\n+++ B\n@@ -1,1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "missing trailing newline is not a difference",
+			a:    "a\nb",
+			b:    "a\nb\n",
+		},
+		{
+			name: "last line without trailing newline",
+			a:    "a\nb",
+			b:    "a\nc",
+			want: "--- A\n+++ B\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+		},
+		{
+			name: "context is cut at 3 lines",
+			a:    lines(1, 9),
+			b:    strings.Replace(lines(1, 9), "lllll\n", "x\n", 1),
+			want: "--- A\n+++ B\n@@ -2,7 +2,7 @@\n ll\n lll\n llll\n-lllll\n+x\n llllll\n lllllll\n llllllll\n",
+		},
+		{
+			name: "changes 6 lines apart share a hunk",
+			a:    "a\n" + lines(1, 6) + "b\n",
+			b:    "x\n" + lines(1, 6) + "y\n",
+			want: "--- A\n+++ B\n@@ -1,8 +1,8 @@\n-a\n+x\n l\n ll\n lll\n llll\n lllll\n llllll\n-b\n+y\n",
+		},
+		{
+			name: "changes 7 lines apart make separate hunks",
+			a:    "a\n" + lines(1, 7) + "b\n",
+			b:    "x\n" + lines(1, 7) + "y\n",
+			want: "--- A\n+++ B\n@@ -1,4 +1,4 @@\n-a\n+x\n l\n ll\n lll\n@@ -6,4 +6,4 @@\n lllll\n llllll\n lllllll\n-b\n+y\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			differ, err := writeUnifiedDiff(&out, "A", "B", tc.a, tc.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tc.want {
+				t.Errorf("got diff:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if differ != (tc.want != "") {
+				t.Errorf("writeUnifiedDiff reported difference: %v", differ)
+			}
+		})
+	}
+}
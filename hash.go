@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// requestKey is the canonical form of a request, hashed with -hash-prompt to
+// get a key for external caches. It leaves out the date line of the system
+// prompt, so that the same request made on another day has the same hash.
+type requestKey struct {
+	Provider  string                        `json:"provider"`
+	Model     string                        `json:"model"`
+	System    string                        `json:"system"`
+	Messages  any                           `json:"messages"`
+	Inference *types.InferenceConfiguration `json:"inference,omitempty"`
+
+	Seed           *int64          `json:"seed,omitempty"`
+	Tools          json.RawMessage `json:"tools,omitempty"`
+	ResponseFields []string        `json:"response_fields,omitempty"`
+}
+
+// keyMessage is the Bedrock message in requestKey.
+type keyMessage struct {
+	Role    types.ConversationRole `json:"role"`
+	Content []keyBlock             `json:"content"`
+}
+
+// keyBlock is the content block of keyMessage.
+type keyBlock struct {
+	Type   string `json:"type"`
+	Format string `json:"format,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// keyMessages converts Bedrock messages for requestKey.
+func keyMessages(msgs []types.Message) []keyMessage {
+	out := make([]keyMessage, 0, len(msgs))
+	for _, m := range msgs {
+		km := keyMessage{Role: m.Role}
+		for _, b := range m.Content {
+			var kb keyBlock
+			switch b := b.(type) {
+			case *types.ContentBlockMemberText:
+				kb = keyBlock{Type: "text", Text: b.Value}
+			case *types.ContentBlockMemberImage:
+				kb = keyBlock{Type: "image", Format: string(b.Value.Format)}
+				if s, ok := b.Value.Source.(*types.ImageSourceMemberBytes); ok {
+					kb.Data = s.Value
+				}
+			case *types.ContentBlockMemberDocument:
+				kb = keyBlock{Type: "document", Format: string(b.Value.Format)}
+				if b.Value.Name != nil {
+					kb.Name = *b.Value.Name
+				}
+				if s, ok := b.Value.Source.(*types.DocumentSourceMemberBytes); ok {
+					kb.Data = s.Value
+				}
+			case *types.ContentBlockMemberAudio:
+				kb = keyBlock{Type: "audio", Format: string(b.Value.Format)}
+				if s, ok := b.Value.Source.(*types.AudioSourceMemberBytes); ok {
+					kb.Data = s.Value
+				}
+			default:
+				kb = keyBlock{Type: "other"}
+			}
+			km.Content = append(km.Content, kb)
+		}
+		out = append(out, km)
+	}
+	return out
+}
+
+// hash returns hex-encoded SHA-256 of the key.
+func (k *requestKey) hash() (string, error) {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// reportHash prints the hash of the request with -hash-prompt, or logs it
+// with -v, and returns true if the request is not to be sent. The system
+// prompt of the key is filled from args.
+func reportHash(args runArgs, key *requestKey) (bool, error) {
+	if !args.noSystem {
+		key.System = string(userSystemPrompt(args))
+	}
+	h, err := key.hash()
+	if err != nil {
+		return false, err
+	}
+	if args.hashPrompt {
+		_, err := fmt.Fprintln(args.out, h)
+		return true, err
+	}
+	if args.v && len(args.tSweep) == 0 && len(args.diff) == 0 && !args.script {
+		log.Printf("request hash: %s", h)
+	}
+	return false, nil
+}
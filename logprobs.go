@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// choiceLogprobs holds log probabilities of the reply tokens, see
+// https://platform.openai.com/docs/api-reference/chat/object
+type choiceLogprobs struct {
+	Content []tokenLogprob `json:"content"`
+}
+
+// tokenLogprob is a log probability of a single token of the reply, along
+// with the most likely alternatives at its position.
+type tokenLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Top     []struct {
+		Token   string  `json:"token"`
+		Logprob float64 `json:"logprob"`
+	} `json:"top_logprobs"`
+}
+
+// writeLogprobs writes a table of tokens with their probabilities, one token
+// per line, followed by the alternatives, if any.
+func writeLogprobs(w io.Writer, tokens []tokenLogprob) error {
+	var b strings.Builder
+	b.WriteString("token log probabilities:\n")
+	for _, t := range tokens {
+		fmt.Fprintf(&b, "%-24q %9.4f %6.2f%%", t.Token, t.Logprob, 100*math.Exp(t.Logprob))
+		sep := "\talternatives: "
+		for _, alt := range t.Top {
+			if alt.Token == t.Token {
+				continue
+			}
+			fmt.Fprintf(&b, "%s%q %.2f%%", sep, alt.Token, 100*math.Exp(alt.Logprob))
+			sep = ", "
+		}
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
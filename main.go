@@ -4,40 +4,59 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/rand"
 	_ "embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
 	"iter"
 	"log"
+	"maps"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/aws/smithy-go"
 	"rsc.io/markdown"
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("llmcli: ")
-	if st, err := os.Stderr.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
-		log.SetPrefix("\033[1m" + log.Prefix() + "\033[0m")
+	cfg, err := loadConfigFile()
+	if err != nil {
+		log.Fatal(err)
 	}
-	args := runArgs{}
+	args := runArgs{format: "text", onThrottle: "fallback", throttleRetries: 3, maxImages: 20, att: blockOptions{splitChars: 200_000, docTags: cfg.DocumentTags}, config: cfg}
 	flag.StringVar(&args.q, "q", args.q, "your `prompt` to LLM."+
 		"\nYou can also provide prompt over stdin."+
 		"\nIf you provide data on stdin AND use this flag¹,"+
@@ -45,180 +64,1677 @@ func main() {
 		"\nand the text provided using this flag goes after that."+
 		"\n\n¹ Note that when you use this flag and stdin is a terminal,"+
 		"\n it is NOT read to avoid the illusion of blocking.")
+	var q64 string
+	flag.StringVar(&q64, "q64", q64, "base64-encoded `prompt`, use instead of -q to avoid shell quoting issues")
+	flag.BoolVar(&args.noStdin, "no-stdin", args.noStdin, "don't read stdin, even if it's a pipe; the prompt then comes from -q or its alternatives")
+	flag.BoolVar(&args.forceStdin, "force-stdin", args.forceStdin, "read stdin along with -q, even if it's a terminal")
+	flag.BoolVar(&args.qFirstLine, "q-firstline", args.qFirstLine, "take the prompt from the first non-empty line of stdin, and the rest of stdin as a document,"+
+		"\nas if it was passed with -q")
+	flag.BoolVar(&args.includes, "includes", args.includes, "replace \"@include path\" lines of the prompt with contents of the referenced files")
 	flag.Func("f", "`file` to attach (can be used multiple times)", func(name string) error {
 		if name != "" {
 			args.attach = append(args.attach, name)
 		}
 		return nil
 	})
-	flag.Func("t", "temperature parameter for LLM, [0, 1] range.\nHigher values like 0.8 will make the output more random, while\nlower values like 0.2 will make it more focused and deterministic.", func(val string) error {
-		v, err := strconv.ParseFloat(val, 32)
+	flag.Func("t", "temperature parameter for LLM, [0, 1] range.\nHigher values like 0.8 will make the output more random, while\nlower values like 0.2 will make it more focused and deterministic."+
+		"\nDefaults to the value of LLMCLI_TEMPERATURE environment variable, if set", func(val string) error {
+		t, err := parseTemperature(val)
+		if err != nil {
+			return err
+		}
+		args.t = &t
+		return nil
+	})
+	flag.Func("infer", "inference parameters as json `object` with temperature, topP, maxTokens, and stopSequences fields,"+
+		"\nlike {\"temperature\":0.3,\"stopSequences\":[\"END\"]}. Individual flags, like -t, override its fields", func(val string) error {
+		dec := json.NewDecoder(strings.NewReader(val))
+		dec.DisallowUnknownFields()
+		var c types.InferenceConfiguration
+		if err := dec.Decode(&c); err != nil {
+			return err
+		}
+		args.infer = &c
+		return nil
+	})
+	flag.Func("t-sweep", "comma-separated `list` of temperatures to run the same request with, one after another", func(val string) error {
+		args.tSweep = args.tSweep[:0]
+		for _, s := range strings.Split(val, ",") {
+			t, err := parseTemperature(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			args.tSweep = append(args.tSweep, t)
+		}
+		return nil
+	})
+	flag.Func("seed", "`number` to make sampling deterministic, as far as the model allows (chatgpt only)."+
+		"\nWith -v, the backend system fingerprint is also reported", func(val string) error {
+		v, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		args.seed = &v
+		return nil
+	})
+	flag.Func("logprobs", "print log probabilities of reply tokens to stderr after the reply, along with this `number`"+
+		"\nof the most likely alternatives for each token, 0 to 20 (chatgpt only)", func(val string) error {
+		v, err := strconv.Atoi(val)
 		if err != nil {
 			return err
 		}
-		if v < 0 || v > 1 {
-			return errors.New("temperature must be within [0, 1] range")
+		if v < 0 || v > 20 {
+			return errors.New("must be within [0, 20] range")
+		}
+		args.logprobs = &v
+		return nil
+	})
+	args.headers = make(http.Header)
+	for _, line := range strings.Split(os.Getenv("LLMCLI_OPENAI_HEADERS"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, err := parseHeader(line)
+		if err != nil {
+			log.Fatalf("LLMCLI_OPENAI_HEADERS: %v", err)
+		}
+		args.headers.Add(name, value)
+	}
+	flag.Func("header", "extra http `header` in the \"Name: Value\" form for OpenAI API requests (chatgpt only),"+
+		"\ncan be used multiple times. Also read from LLMCLI_OPENAI_HEADERS environment variable,"+
+		"\none header per line. Headers set this way override the default ones", func(val string) error {
+		name, value, err := parseHeader(val)
+		if err != nil {
+			return err
 		}
-		x := float32(v)
-		args.t = &x
+		args.headers.Add(name, value)
 		return nil
 	})
+	flag.StringVar(&args.tools, "tools", args.tools, "`file` with json array of tools definitions the model may call (chatgpt only)."+
+		"\nTool calls the model requests are printed to stderr")
+	flag.BoolVar(&args.paste, "paste", args.paste, "read system clipboard instead of stdin: its text is used the same way as data on stdin,"+
+		"\nand an image is attached")
 	flag.BoolVar(&args.v, "v", args.v, "output some additional details like token usage")
+	flag.BoolVar(&args.showModel, "show-model", args.showModel, "log the id of the model that handles the request, after alias expansion and fallbacks"+
+		"\n(also done with -v)")
 	if configDir, err := os.UserConfigDir(); err == nil {
 		args.sys = filepath.Join(configDir, "llmcli", "system-prompt.txt")
 	}
-	flag.StringVar(&args.sys, "s", args.sys, "system prompt `file`")
+	args.sys = cmp.Or(configEnv("LLMCLI_SYSTEM_PROMPT", cfg.SystemPrompt), args.sys)
+	flag.BoolVar(&args.summary, "summary", args.summary, "once the reply is complete, log a single line with the model that made it, and the elapsed time;"+
+		"\na lighter alternative to -v")
+	flag.BoolVar(&args.hashPrompt, "hash-prompt", args.hashPrompt, "print SHA-256 hash of the request, as a key for external caches, and exit without sending it."+
+		"\nIt covers the prompt, attachments, system prompt, model, and inference parameters, but not the current date")
+	flag.BoolVar(&args.noSystem, "no-system", args.noSystem, "send no system prompt at all, not even the current date")
+	flag.StringVar(&args.sys, "s", args.sys, "system prompt `file`\n(defaults to LLMCLI_SYSTEM_PROMPT environment variable, then system_prompt of the config file,"+
+		"\nthen llmcli/system-prompt.txt in the user config directory)")
+	flag.StringVar(&args.sysText, "S", args.sysText, "system prompt `text`, takes precedence over -s")
+	flag.Func("system-append", "`text` to add to the end of the system prompt, whichever one takes effect;"+
+		"\ncan be used multiple times", func(val string) error {
+		if strings.TrimSpace(val) == "" {
+			return errors.New("must not be empty")
+		}
+		args.sysAppend = append(args.sysAppend, val)
+		return nil
+	})
 	flag.BoolVar(&args.web, "w", args.web, "treat reply as markdown, convert it to html and open result in a browser")
+	flag.BoolVar(&args.webKeep, "w-keep", args.webKeep, "with -w, keep the html file and log its name, to re-open it later")
+	flag.DurationVar(&args.webCleanup, "w-cleanup", args.webCleanup, "with -w, remove the html file once this `duration` passes after it's opened,"+
+		"\ngiving browser time to load it. The file is removed in the background, llmcli doesn't wait for it."+
+		"\nBy default the file is left in the temporary directory")
+	flag.BoolVar(&args.webServe, "w-serve", args.webServe, "with -w, serve the html page from a short-lived http server on localhost instead of a temporary file."+
+		"\nThe server stops once the browser fetches the page, or after a minute")
+	flag.StringVar(&args.footer, "footer", args.footer, "`text` to append to the reply once it's complete, like a signature; {model} and {date} in it"+
+		"\nare replaced with the model id and the current date. Also included into -w page and files of -save")
+	var polish bool
+	flag.BoolVar(&polish, "polish", polish, "improve grammar and formatting of a single attached markdown file, keeping its meaning;"+
+		"\nthe changes are shown as a diff, and once confirmed, written back to the file, with the original kept as .bak")
+	flag.StringVar(&args.manifest, "manifest", args.manifest, "write json manifest of attachments, with their paths, sizes, formats, and sha256 hashes,"+
+		"\nto this `file` before sending the request, to be able to tell later what context the model saw")
+	flag.Func("response-field", "`path` of additional model-specific field of the response to request, like /stop_sequence,"+
+		"\nthat is printed with -v; support varies by model (Bedrock only). Can be used multiple times", func(val string) error {
+		if !strings.HasPrefix(val, "/") {
+			return errors.New("must be a JSON Pointer path, starting with /")
+		}
+		args.responseFields = append(args.responseFields, val)
+		return nil
+	})
+	flag.Func("metadata", "`key=value` pair to tag Bedrock requests with, as their requestMetadata,"+
+		"\nwhich is recorded in model invocation logs (Bedrock only). Can be used multiple times", func(val string) error {
+		k, v, ok := strings.Cut(val, "=")
+		if !ok || k == "" || v == "" {
+			return errors.New("must be in the key=value form, with non-empty key and value")
+		}
+		if len(k) > 256 || len(v) > 256 {
+			return errors.New("key and value must be at most 256 characters long")
+		}
+		if args.metadata == nil {
+			args.metadata = make(map[string]string)
+		}
+		if _, ok := args.metadata[k]; !ok && len(args.metadata) == 16 {
+			return errors.New("at most 16 pairs are allowed")
+		}
+		args.metadata[k] = v
+		return nil
+	})
+	flag.Func("template", "Go text/`template` to print the reply with, instead of as is, either inline, or as @file."+
+		"\nIt gets .Text (the reply), .Model, .Usage (with .Input, .Output, .Total fields), and .Date (time.Time).\n"+
+		"The reply is printed only once it is complete", func(val string) error {
+		t, err := parseTemplate(val)
+		if err != nil {
+			return err
+		}
+		args.template = t
+		return nil
+	})
+	flag.StringVar(&args.stopFile, "stop-file", args.stopFile, "stop generating the reply, the same way as on Ctrl-C or SIGTERM, once this `file` is created,"+
+		"\nor removed, if it exists at the start")
+	flag.BoolVar(&args.plain, "plain", args.plain, "treat reply as markdown and print it as plain text, without formatting."+
+		"\nThe reply is printed only once it is complete. Ignored if output is a terminal")
+	flag.BoolVar(&args.onlyCode, "only-code", args.onlyCode, "print only the contents of fenced code blocks from the reply, separated by empty lines."+
+		"\nThe reply is printed only once it is complete")
+	flag.BoolVar(&args.firstCode, "first-code", args.firstCode, "like -only-code, but print only the first code block")
+	flag.Func("md-file", "also save the reply as is, in markdown, to this `file`; same as -save md:file", func(val string) error {
+		args.sinks = append(args.sinks, outputSink{format: "md", name: val})
+		return nil
+	})
+	flag.Func("save", "also save the reply to a file, given as `format:file`, where format is one of:"+
+		"\nmd — as is, plain — as with -plain, code — as with -only-code, html — as with -w."+
+		"\nCan be used multiple times", func(val string) error {
+		s, err := parseSink(val)
+		if err != nil {
+			return err
+		}
+		args.sinks = append(args.sinks, s)
+		return nil
+	})
+	flag.Func("copy", "also copy the complete reply to the system clipboard, in the given `format`: md, plain, or code", func(val string) error {
+		s, err := parseClipboardSink(val)
+		if err != nil {
+			return err
+		}
+		args.sinks = append(args.sinks, s)
+		return nil
+	})
+	flag.BoolVar(&args.frontmatter, "frontmatter", args.frontmatter, "with -md-file, start the file with YAML frontmatter describing the model, time, prompt,"+
+		"\nand token usage; with -w and html files of -save, put these details into html <meta> tags")
+	var noTables, noAutolink bool
+	flag.BoolVar(&noTables, "no-tables", noTables, "don't recognize tables when converting reply to html with -w")
+	flag.BoolVar(&noAutolink, "no-autolink", noAutolink, "don't turn bare urls into links when converting reply to html with -w")
+	setOnThrottle := func(val string) error {
+		switch val {
+		case "fallback", "wait", "fail":
+			args.onThrottle = val
+			args.throttleFallback = val == "fallback"
+			return nil
+		}
+		return errors.New("must be one of: fallback, wait, fail")
+	}
+	if val := configEnv("LLMCLI_ON_THROTTLE", cfg.OnThrottle); val != "" {
+		if err := setOnThrottle(val); err != nil {
+			log.Fatalf("on_throttle or LLMCLI_ON_THROTTLE: %v", err)
+		}
+	}
+	flag.Func("on-throttle", "what to do when all retries of Bedrock request were throttled:"+
+		"\nfallback — try the next model from LLMCLI_MODEL_CHAIN (default);"+
+		"\n  if set explicitly and there's no chain, fall back to "+fallbackModelId+","+
+		"\nwait — wait and retry the same model up to -throttle-retries more times,"+
+		"\nfail — give up."+
+		"\nDefaults to the value of LLMCLI_ON_THROTTLE environment variable, if set", setOnThrottle)
+	flag.IntVar(&args.throttleRetries, "throttle-retries", args.throttleRetries, "`number` of extra attempts with -on-throttle=wait")
+	flag.IntVar(&args.maxImages, "max-images", args.maxImages, "refuse to send the request with more than this `number` of attached images, 0 means no limit")
+	flag.IntVar(&args.maxOutputBytes, "max-output-bytes", args.maxOutputBytes, "stop the reply once it grows past this many `bytes`, 0 means no limit")
+	flag.IntVar(&args.summarizeOver, "summarize-attachments", args.summarizeOver, "replace attached text files longer than this many `characters` with their summaries,"+
+		"\nmade by a quick model from LLMCLI_SUMMARY_MODEL (default haiku); 0 disables (Bedrock only)")
+	flag.BoolVar(&args.fast, "fast", args.fast, "use latency-optimized inference, if the model supports it (Bedrock only)."+
+		"\nAvailability depends on the model and region, it's ignored with a warning where not supported")
+	var streamDelay time.Duration
+	flag.DurationVar(&streamDelay, "stream-delay", streamDelay, "pause for this `duration` between chunks of reply, for a typewriter effect."+
+		"\nOnly applies when output is a terminal")
+	flag.BoolVar(&args.retryTruncated, "retry-truncated", args.retryTruncated, "repeat the request, up to 2 times, if the reply stream is cut off before its end (chatgpt only)."+
+		"\nThe reply is then printed only once it is complete. Otherwise such reply is reported as an error")
+	flag.BoolVar(&args.noStream, "no-stream", args.noStream, "wait for the complete reply instead of streaming it")
+	flag.StringVar(&args.since, "since", args.since, "shell `command` to run, attaching its combined stdout and stderr output."+
+		"\nUse it to ask about why some command failed")
+	flag.BoolFunc("since-commit", "attach changes of the git working tree in the current directory since this `ref`,"+
+		"\nas reported by git diff; use as -since-commit=ref, or just -since-commit for HEAD", func(val string) error {
+		if val == "true" {
+			val = "HEAD"
+		}
+		if val == "" || strings.HasPrefix(val, "-") {
+			return errors.New("must be a git reference, like HEAD or main")
+		}
+		args.sinceCommit = val
+		return nil
+	})
+	flag.StringVar(&args.examples, "examples", args.examples, "`directory` with few-shot examples to put before the prompt,"+
+		"\nas pairs of NNN.user.txt and NNN.assistant.txt files")
+	flag.BoolVar(&args.att.lineNumbers, "line-numbers", args.att.lineNumbers, "prefix each line of attached text files with its number")
+	flag.BoolVar(&args.att.codeContext, "code-context", args.att.codeContext, "start attached source files with a <code-context> header stating their language,"+
+		"\nnumber of lines, and modification time")
+	flag.BoolVar(&args.att.bare, "bare-attachment", args.att.bare, "if there is no prompt, send the only attached text file as the prompt as is,"+
+		"\nwithout wrapping it within <document> tags")
+	flag.BoolVar(&args.att.numbered, "number-docs", args.att.numbered, "number attached files as index attribute of <document> tags,"+
+		"\nso that the prompt can refer to them like “document 2”")
+	flag.BoolVar(&args.att.scan, "scan-attachments", args.att.scan, "warn about phrases in attached text files that look like attempts of prompt injection,"+
+		"\nsuch as “ignore previous instructions”; this is a heuristic")
+	flag.Func("image-format", "`format` of attached images to use instead of the detected one: jpeg, png, gif, or webp."+
+		"\nAlso applies to files with image extensions, that are not detected as images", func(val string) error {
+		if !slices.Contains(types.ImageFormat("").Values(), types.ImageFormat(val)) {
+			return errors.New("must be one of: jpeg, png, gif, webp")
+		}
+		args.att.imageFormat = types.ImageFormat(val)
+		return nil
+	})
+	flag.IntVar(&args.att.splitChars, "split-chars", args.att.splitChars, "split attached text files longer than this many characters into several parts, 0 disables")
+	flag.Func("format", "output `format`: text (default) or ndjson"+
+		"\n(newline-delimited json objects, one per each chunk of reply)", func(val string) error {
+		switch val {
+		case "text", "ndjson":
+			args.format = val
+			return nil
+		}
+		return errors.New("unsupported format")
+	})
+	var status bool
+	flag.BoolVar(&status, "status", status, "check connectivity and credentials of the active provider, then exit")
+	var preview bool
+	flag.BoolVar(&preview, "preview", preview, "show how each attached file is going to be sent: as text inlined into the prompt,"+
+		"\nimage, document, or audio, with its format and size, then exit without sending the request")
+	retryLog := os.Getenv("LLMCLI_RETRY_LOG")
+	flag.StringVar(&retryLog, "retry-log", retryLog, "append records of retried requests to this `file`"+
+		"\n(also set by LLMCLI_RETRY_LOG environment variable)")
+	var debug bool
+	flag.BoolVar(&debug, "debug", debug, "print the original error along with the explanation of AWS credentials problems")
+	flag.BoolVar(&args.script, "script", args.script, "read several prompts from stdin, separated by lines of three dashes (---),"+
+		"\nand send them one after another within the same conversation, each after the reply to the previous one")
+	var verboseErrors bool
+	flag.BoolVar(&verboseErrors, "verbose-errors", verboseErrors, "on failure, print every layer of the error chain, and details of AWS API errors,"+
+		"\nsuch as request id, to include into support requests")
+	flag.Func("diff", "comma-separated `pair` of model ids or temperatures to run the same request with,"+
+		"\nthen print the unified diff of the two replies", func(val string) error {
+		a, b, ok := strings.Cut(val, ",")
+		if !ok || strings.Contains(b, ",") {
+			return errors.New("must be exactly two comma-separated values")
+		}
+		args.diff = args.diff[:0]
+		for _, s := range []string{a, b} {
+			d, err := parseDiffSide(s)
+			if err != nil {
+				return err
+			}
+			args.diff = append(args.diff, d)
+		}
+		return nil
+	})
+	flag.Func("request-id", "client-generated `id` of the request, logged with -v or -debug, and sent with chatgpt requests"+
+		"\nas X-Client-Request-Id header, to correlate with provider-side logs. A random id is used if not set", func(val string) error {
+		if val == "" || len(val) > 512 {
+			return errors.New("must be from 1 to 512 characters long")
+		}
+		for _, r := range val {
+			if r < ' ' || r > '~' {
+				return errors.New("must only consist of printable ASCII characters")
+			}
+		}
+		args.requestID = val
+		return nil
+	})
+	noColor := os.Getenv("NO_COLOR") != ""
+	flag.BoolVar(&noColor, "no-color", noColor, "don't use ANSI escape sequences in output (also set by NO_COLOR environment variable)")
+	var fd int
+	flag.IntVar(&fd, "fd", -1, "write reply to this already open file `descriptor` instead of stdout")
 	flag.Parse()
+	args.att.extFormats = loadExtensions()
+	args.md.Table = !noTables
+	args.md.AutoLinkText = !noAutolink
+	if st, err := os.Stderr.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 && args.format == "text" && !noColor {
+		log.SetPrefix("\033[1m" + log.Prefix() + "\033[0m")
+	}
+	if args.t != nil && len(args.tSweep) != 0 {
+		log.Fatal("-t and -t-sweep flags are mutually exclusive")
+	}
+	if val := os.Getenv("LLMCLI_TEMPERATURE"); val != "" && args.t == nil && len(args.tSweep) == 0 &&
+		(args.infer == nil || args.infer.Temperature == nil) {
+		if t, err := parseTemperature(val); err == nil {
+			args.t = &t
+		} else {
+			log.Printf("ignoring LLMCLI_TEMPERATURE: %v", err)
+		}
+	}
+	if len(args.tSweep) != 0 && args.format == "ndjson" {
+		log.Fatal("-t-sweep is not supported with ndjson format")
+	}
+	args.onlyCode = args.onlyCode || args.firstCode
+	if (args.plain || args.onlyCode) && args.format == "ndjson" {
+		log.Fatal("-plain and -only-code are not supported with ndjson format")
+	}
+	if args.plain && args.onlyCode {
+		log.Fatal("-plain and -only-code flags are mutually exclusive")
+	}
+	if args.noStdin && args.forceStdin {
+		log.Fatal("-no-stdin and -force-stdin flags are mutually exclusive")
+	}
+	if args.noStdin && (args.qFirstLine || args.script) {
+		log.Fatal("-no-stdin can't be used with -q-firstline or -script, which read stdin")
+	}
+	if args.forceStdin && (args.paste || polish) {
+		log.Fatal("-force-stdin can't be used with -paste or -polish")
+	}
+	if args.qFirstLine && (args.q != "" || q64 != "" || len(flag.Args()) != 0 || args.script) {
+		log.Fatal("-q-firstline can't be used with -q, -q64, a prompt given as arguments, or -script")
+	}
+	if args.att.bare && len(slices.Compact(args.attach)) != 1 {
+		log.Fatal("-bare-attachment needs exactly one file attached with -f")
+	}
+	if args.noSystem && (args.sysText != "" || len(args.sysAppend) != 0) {
+		log.Fatal("-no-system can't be used with -S or -system-append")
+	}
+	if args.hashPrompt && (args.script || len(args.tSweep) != 0 || len(args.diff) != 0 || args.summarizeOver > 0 || polish) {
+		log.Fatal("-hash-prompt can't be used with -script, -t-sweep, -diff, -summarize-attachments, or -polish")
+	}
+	if args.script && (args.q != "" || len(args.tSweep) != 0 || len(args.diff) != 0 || args.format == "ndjson") {
+		log.Fatal("-script can't be used with -q, -t-sweep, -diff, or ndjson format")
+	}
+	if args.template != nil && (args.plain || args.onlyCode || args.format == "ndjson" || len(args.diff) != 0) {
+		log.Fatal("-template can't be used with -plain, -only-code, -diff, or ndjson format")
+	}
+	if args.footer != "" && (args.format == "ndjson" || len(args.diff) != 0) {
+		log.Fatal("-footer can't be used with -diff or ndjson format")
+	}
+	if polish {
+		if len(args.attach) != 1 {
+			log.Fatal("-polish needs exactly one markdown file attached with -f")
+		}
+		if args.q != "" || q64 != "" || len(flag.Args()) != 0 || args.script || args.paste || len(args.tSweep) != 0 || len(args.diff) != 0 ||
+			args.format == "ndjson" || args.web || args.convertReply() || len(args.sinks) != 0 || args.footer != "" {
+			log.Fatal("-polish can't be used with a prompt, -script, -paste, -t-sweep, -diff, -w, -plain, -only-code, -md-file, -save, -footer, or ndjson format")
+		}
+		if args.sysText != "" || len(args.sysAppend) != 0 {
+			log.Fatal("-polish uses its own system prompt, and can't be used with -S or -system-append")
+		}
+		if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+			log.Fatal("-polish needs stdin to be a terminal, to confirm overwriting the file")
+		}
+		if err := checkPolishFile(args.attach[0]); err != nil {
+			log.Fatal(err)
+		}
+		args.polish = args.attach[0]
+		args.q = polishPrompt
+	}
+	if args.webKeep && args.webCleanup > 0 {
+		log.Fatal("-w-keep and -w-cleanup flags are mutually exclusive")
+	}
+	if args.webServe && (args.webKeep || args.webCleanup > 0) {
+		log.Fatal("-w-serve can't be used with -w-keep or -w-cleanup")
+	}
+	if len(args.diff) != 0 && (len(args.tSweep) != 0 || args.format == "ndjson" || args.convertReply() || args.web || len(args.sinks) != 0) {
+		log.Fatal("-diff can't be used with -t-sweep, -plain, -only-code, -w, -md-file, -save, or ndjson format")
+	}
+	if q64 != "" {
+		if args.q != "" {
+			log.Fatal("-q and -q64 flags are mutually exclusive")
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(q64))
+		if err != nil {
+			log.Fatalf("invalid base64 prompt: %v", err)
+		}
+		if !utf8.Valid(b) {
+			log.Fatal("invalid base64 prompt: not a valid utf8")
+		}
+		args.q = string(b)
+	}
 	if args.q == "" && len(flag.Args()) != 0 {
 		args.q = strings.Join(flag.Args(), " ")
 	}
+	if retryLog != "" {
+		f, err := os.OpenFile(retryLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		args.retryLog = log.New(f, "", log.LstdFlags)
+	}
+	if args.requestID == "" {
+		args.requestID = rand.Text()
+	}
+	if args.v || debug {
+		log.Printf("request id: %s", args.requestID)
+	}
+	if args.paste {
+		var err error
+		if args.clipboard, args.clipboardImage, err = readClipboard(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if status {
+		if err := checkStatus(context.Background(), os.Stdout, args.headers, &args.config); err != nil {
+			if verboseErrors {
+				logErrorChain(err)
+			}
+			var ce *awsCredentialsError
+			if debug && errors.As(err, &ce) {
+				log.Print(ce.err)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	if preview {
+		if len(args.attach) == 0 {
+			log.Fatal("-preview needs files attached with -f")
+		}
+		if err := previewAttachments(context.Background(), os.Stdout, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	args.out = os.Stdout
+	if fd >= 0 {
+		f, err := openFd(fd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args.out = f
+	}
+	if f, ok := args.out.(*os.File); ok && args.plain {
+		if st, err := f.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+			args.plain = false
+		}
+	}
+	if f, ok := args.out.(*os.File); ok && streamDelay > 0 {
+		if st, err := f.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+			args.out = &pacedWriter{w: f, delay: streamDelay}
+		}
+	}
+	var polished bytes.Buffer
+	if args.polish != "" {
+		args.out = &polished
+	}
 	if err := run(context.Background(), args); err != nil {
+		if verboseErrors {
+			logErrorChain(err)
+		}
+		var ce *awsCredentialsError
+		if debug && errors.As(err, &ce) {
+			log.Print(ce.err)
+		}
 		var ee *exec.ExitError
 		if errors.As(err, &ee) && len(ee.Stderr) != 0 {
 			os.Stderr.Write(ee.Stderr)
 		}
+		var fe *contentFilterError
+		if errors.As(err, &fe) {
+			log.Print(err)
+			os.Exit(exitContentFiltered)
+		}
 		log.Fatal(err)
 	}
+	if args.polish != "" {
+		if err := savePolished(args.polish, polished.Bytes()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// logErrorChain logs every error in the chain of wrapped errors, followed by
+// details of AWS API error, if it's one.
+func logErrorChain(err error) {
+	for i, e := 0, err; e != nil; i, e = i+1, errors.Unwrap(e) {
+		log.Printf("error #%d (%T): %v", i, e, e)
+	}
+	var oe *smithy.OperationError
+	if errors.As(err, &oe) {
+		log.Printf("service: %s, operation: %s", oe.Service(), oe.Operation())
+	}
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		log.Printf("request id: %s, http status: %d", re.ServiceRequestID(), re.HTTPStatusCode())
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		log.Printf("error code: %s, fault: %s, message: %s", ae.ErrorCode(), ae.ErrorFault(), ae.ErrorMessage())
+	}
+}
+
+// parseTemperature parses temperature value, making sure it's within [0, 1] range.
+func parseTemperature(val string) (float32, error) {
+	v, err := strconv.ParseFloat(val, 32)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v > 1 {
+		return 0, errors.New("temperature must be within [0, 1] range")
+	}
+	return float32(v), nil
 }
 
 type runArgs struct {
-	q      string
-	sys    string
-	attach []string
-	v      bool
-	web    bool
-	t      *float32
+	q        string
+	sys      string
+	attach   []string
+	examples string
+	since    string // command to attach output of
+	v        bool
+	web      bool
+	plain    bool            // print reply converted from markdown to plain text
+	md       markdown.Parser // parser used to convert reply to html
+	noStream bool
+	tSweep   []float32 // temperatures to run the same request with
+	format   string    // "text" or "ndjson"
+	t        *float32
+	seed     *int64    // sampling seed, chatgpt only
+	logprobs *int      // number of alternatives to report log probabilities of tokens with, chatgpt only
+	out      io.Writer // where to write reply to
+	att      blockOptions
+
+	onThrottle       string // "fallback", "wait", or "fail"
+	throttleRetries  int
+	throttleFallback bool // -on-throttle=fallback was set explicitly
+
+	onlyCode  bool         // print only fenced code blocks from reply
+	firstCode bool         // with onlyCode, print only the first code block
+	sinks     []outputSink // files and clipboard to save reply to
+
+	frontmatter bool   // describe reply with frontmatter in markdown files, and <meta> tags in html
+	tools       string // file with json definitions of tools, chatgpt only
+
+	maxOutputBytes int         // stop reply once it exceeds this size
+	headers        http.Header // extra headers for OpenAI API requests
+	retryLog       *log.Logger // where to record retries of failed requests, if not nil
+
+	paste          bool   // use clipboard instead of stdin
+	clipboard      []byte // clipboard contents read with -paste
+	clipboardImage bool   // whether clipboard holds an image
+
+	diff []diffSide // two configurations to compare replies of
+
+	fast bool // use latency-optimized inference, Bedrock only
+
+	summarizeOver int // summarize attached text longer than this many characters, Bedrock only
+
+	maxImages int // maximum number of attached images, 0 means no limit
+
+	script bool // stdin holds several prompts of the same conversation
+
+	noSystem bool // send no system prompt at all
+
+	retryTruncated bool // repeat chatgpt request if reply stream is cut off
+
+	webKeep    bool          // log the name of html file -w creates
+	webCleanup time.Duration // remove html file -w creates after this delay
+
+	webServe bool // serve -w page over localhost http instead of a file
+
+	requestID string // client-generated id to correlate with provider logs
+
+	infer *types.InferenceConfiguration // inference parameters from -infer
+
+	showModel bool // log the model id the request went to
+
+	footer string // template of text to append to the reply
+
+	polish string // markdown file to improve with -polish
+
+	manifest string // file to write json manifest of attachments to
+
+	qFirstLine bool // take the prompt from the first line of stdin
+	noStdin    bool // never read stdin
+	forceStdin bool // read stdin even if it's a terminal and there's -q
+	includes   bool // expand @include lines of the prompt
+
+	responseFields []string          // additional model response field paths to request, Bedrock only
+	metadata       map[string]string // requestMetadata of Bedrock requests
+
+	sinceCommit string // git ref to attach the diff of working tree against
+
+	template *template.Template // template to print reply with, instead of as is
+
+	stopFile string // creating or removing this file cancels the request
+
+	hashPrompt bool // print hash of the request instead of sending it
+
+	summary bool // log the model and the elapsed time once the reply is complete
+
+	sysText   string   // system prompt given inline, takes precedence over sys file
+	sysAppend []string // texts to add to the end of the system prompt
+
+	config fileConfig // settings from the config file
+}
+
+// blockOptions control how attachments are converted to content blocks
+type blockOptions struct {
+	lineNumbers bool // number lines of text documents inlined into the prompt
+	splitChars  int  // split inlined text documents into parts of at most this many characters, 0 disables
+	numbered    bool // number attachments so that prompt can refer to them
+	index       int  // number of the attachment being converted, used if numbered is set
+	scan        bool // warn about text that looks like prompt injection
+
+	imageFormat types.ImageFormat // if set, used for all images instead of the detected one
+
+	extFormats map[string]types.DocumentFormat // user-defined formats of documents by file extensions
+
+	docTags map[types.DocumentFormat]string // tags to wrap inlined documents of particular formats with
+
+	codeContext bool      // describe inlined source files: language, number of lines, modification time
+	modTime     time.Time // modification time of the file being converted, if known
+
+	bare bool // inline text documents as is, without wrapping them within tags
+}
+
+// bareAttachment reports whether the only attachment is to be sent as the
+// whole prompt, without <document> tags: with -bare-attachment, when there's
+// no prompt and no other input.
+func bareAttachment(args runArgs, prompt string) bool {
+	return args.att.bare && prompt == "" && args.since == "" && args.sinceCommit == "" && !args.clipboardImage
+}
+
+// errBareAttachment is reported when the prompt is empty, because of
+// -bare-attachment, but the attachment can't take its place.
+var errBareAttachment = errors.New("empty prompt: -bare-attachment needs a single text file and no other input, or use the -q flag")
+
+// docTag returns the name of the tag to wrap inlined document of the given
+// format with: "document", unless configured otherwise.
+func (o blockOptions) docTag(format types.DocumentFormat) string {
+	return cmp.Or(o.docTags[format], "document")
+}
+
+// docAttrs returns attributes for the <document> tag wrapping the attachment.
+func (o blockOptions) docAttrs() string {
+	if !o.numbered {
+		return ""
+	}
+	return fmt.Sprintf(" index=\"%d\"", o.index)
+}
+
+// openFd returns a file for the inherited file descriptor fd, making sure that
+// it can be written to.
+func openFd(fd int) (*os.File, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	if _, err := f.Write(nil); err != nil {
+		return nil, fmt.Errorf("file descriptor %d is not writable: %w", fd, err)
+	}
+	return f, nil
 }
 
 func run(ctx context.Context, args runArgs) error {
-	if filepath.Base(os.Args[0]) == "chatgpt" {
+	if args.config.useChatgpt() {
 		return chatgpt(ctx, args)
 	}
+	if args.seed != nil {
+		return errors.New("-seed flag is only supported by chatgpt")
+	}
+	if args.logprobs != nil {
+		return errors.New("-logprobs flag is only supported by chatgpt")
+	}
+	if args.tools != "" {
+		return errors.New("-tools flag is only supported by chatgpt")
+	}
 	prompt, err := readPrompt(args)
 	if err != nil {
 		return err
 	}
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	started := time.Now() // for -summary, not counting time to type the prompt
+	var turns []string    // prompts of -script, sent one after another
+	if args.script {
+		if turns = splitScript(prompt); len(turns) == 0 {
+			return errors.New("no prompts found in the script")
+		}
+		prompt = turns[0]
+	}
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	if args.stopFile != "" {
+		watchStopFile(ctx, args.stopFile, cancel)
+	}
 	var contentBlocks []types.ContentBlock
+	var summarize []summarySpan // attachments to replace with their summaries
+	var images []string         // names of attachments, one per image
+	var entries []manifestEntry // for -manifest
 	handler := loadHandlers()
-	for _, name := range slices.Compact(args.attach) {
-		block, err := handler.attToBlock(ctx, name)
+	for i, name := range slices.Compact(args.attach) {
+		opts := args.att
+		opts.index = i + 1
+		opts.bare = bareAttachment(args, prompt)
+		blocks, err := handler.attToBlock(ctx, name, opts)
+		if err != nil {
+			return err
+		}
+		if args.summarizeOver > 0 && textLength(blocks) > args.summarizeOver {
+			summarize = append(summarize, summarySpan{start: len(contentBlocks), end: len(contentBlocks) + len(blocks), name: name, opts: opts, entry: len(entries)})
+		}
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry(name, blocks))
+		}
+		for _, b := range blocks {
+			if _, ok := b.(*types.ContentBlockMemberImage); ok {
+				images = append(images, name)
+			}
+		}
+		contentBlocks = append(contentBlocks, blocks...)
+	}
+	if args.since != "" {
+		block, err := commandOutputBlock(ctx, args.since)
 		if err != nil {
 			return err
 		}
 		contentBlocks = append(contentBlocks, block)
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("-since="+args.since, []types.ContentBlock{block}))
+		}
 	}
-	contentBlocks = append(contentBlocks, &types.ContentBlockMemberText{Value: prompt})
-
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile("llmcli"))
-	var e config.SharedConfigProfileNotExistError
-	if errors.As(err, &e) {
-		cfg, err = config.LoadDefaultConfig(ctx)
+	if args.sinceCommit != "" {
+		block, err := gitDiffBlock(ctx, args.sinceCommit)
+		if err != nil {
+			return err
+		}
+		contentBlocks = append(contentBlocks, block)
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("-since-commit="+args.sinceCommit, []types.ContentBlock{block}))
+		}
+	}
+	if args.clipboardImage {
+		blocks, err := contentBlockFromBytes("clipboard.png", args.clipboard, http.DetectContentType(args.clipboard), args.att)
+		if err != nil {
+			return err
+		}
+		contentBlocks = append(contentBlocks, blocks...)
+		images = append(images, "clipboard")
+		if args.manifest != "" {
+			entries = append(entries, newManifestEntry("clipboard", blocks))
+		}
 	}
+	if err := checkImageCount(images, args.maxImages); err != nil {
+		return err
+	}
+	if prompt != "" {
+		contentBlocks = append(contentBlocks, &types.ContentBlockMemberText{Value: prompt})
+	} else if len(contentBlocks) != 1 || textLength(contentBlocks) <= 0 {
+		return errBareAttachment
+	}
+	examples, err := loadExamples(args.examples)
 	if err != nil {
 		return err
 	}
-	cl := bedrockruntime.NewFromConfig(cfg, func(o *bedrockruntime.Options) {
-		o.Retryer = retry.NewStandard(func(o *retry.StandardOptions) { o.MaxAttempts = 6 })
-	})
 
-	const fallbackModelId = "anthropic.claude-3-sonnet-20240229-v1:0"
-	var modelId = cmp.Or(os.Getenv("LLMCLI_MODEL"), "anthropic.claude-3-5-sonnet-20240620-v1:0")
-	switch modelId {
-	case "haiku":
-		modelId = "anthropic.claude-3-haiku-20240307-v1:0"
-	}
-	input := &bedrockruntime.ConverseStreamInput{
-		ModelId: &modelId,
-		Messages: []types.Message{
-			{
-				Role:    types.ConversationRoleUser,
-				Content: contentBlocks,
-			},
-		},
+	cl, setup, err := bedrockClient(ctx, args.retryLog)
+	if err != nil {
+		return credentialsError(err, setup)
+	}
+	for _, s := range slices.Backward(summarize) {
+		block, err := summarizeAttachment(ctx, cl, contentBlocks[s.start:s.end], s, args.metadata)
+		if err != nil {
+			return credentialsError(err, setup)
+		}
+		if args.v {
+			log.Printf("%s is summarized with %s", s.name, summaryModel())
+		}
+		contentBlocks = slices.Replace(contentBlocks, s.start, s.end, block)
+		if args.manifest != "" {
+			entries[s.entry] = newManifestEntry(s.name, []types.ContentBlock{block})
+			entries[s.entry].Summarized = true
+		}
 	}
+	if args.manifest != "" {
+		if err := writeManifest(args.manifest, args.requestID, entries); err != nil {
+			return err
+		}
+	}
+
+	models := args.config.modelChain(args.throttleFallback)
+	input := &bedrockruntime.ConverseStreamInput{}
+	for _, ex := range examples {
+		input.Messages = append(input.Messages,
+			types.Message{Role: types.ConversationRoleUser, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: ex.user}}},
+			types.Message{Role: types.ConversationRoleAssistant, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: ex.assistant}}},
+		)
+	}
+	input.Messages = append(input.Messages, types.Message{
+		Role:    types.ConversationRoleUser,
+		Content: contentBlocks,
+	})
 	systemPrompt := time.Now().Local().AppendFormat(nil, "Today is Monday, 02 Jan 2006, time zone MST")
-	if args.sys != "" {
-		if b, err := os.ReadFile(args.sys); err == nil {
-			b = bytes.TrimSpace(b)
-			if len(b) != 0 && utf8.Valid(b) {
-				systemPrompt = append(systemPrompt, ".\n"...)
-				systemPrompt = append(systemPrompt, b...)
+	if b := userSystemPrompt(args); b != nil {
+		systemPrompt = append(systemPrompt, ".\n"...)
+		systemPrompt = append(systemPrompt, b...)
+	}
+	if !args.noSystem {
+		input.System = []types.SystemContentBlock{&types.SystemContentBlockMemberText{Value: string(systemPrompt)}}
+	}
+	if len(args.config.Routes) != 0 && len(args.diff) == 0 {
+		n := estimateTokens(input)
+		if m, ok := args.config.routeModel(n); ok {
+			if args.v {
+				log.Printf("request is about %d tokens, routing it to model %s", n, m)
 			}
+			models = append([]string{m}, slices.DeleteFunc(models, func(s string) bool { return s == m })...)
 		}
 	}
-	input.System = []types.SystemContentBlock{&types.SystemContentBlockMemberText{Value: string(systemPrompt)}}
-	if args.t != nil {
-		input.InferenceConfig = &types.InferenceConfiguration{Temperature: args.t}
+	input.ModelId = &models[0]
+	input.AdditionalModelResponseFieldPaths = args.responseFields
+	input.RequestMetadata = args.metadata
+	if args.fast {
+		input.PerformanceConfig = &types.PerformanceConfiguration{Latency: types.PerformanceConfigLatencyOptimized}
 	}
-	out, err := cl.ConverseStream(ctx, input)
-	var te *types.ThrottlingException
-	if errors.As(err, &te) {
-		if ok, _ := strconv.ParseBool(os.Getenv("LLMCLI_FALLBACK_ON_THROTTLE")); ok && *input.ModelId != fallbackModelId {
-			log.Printf("all retries were throttled, falling back to model %s", fallbackModelId)
-			s := fallbackModelId
-			input.ModelId = &s
-			out, err = cl.ConverseStream(ctx, input)
+	if args.hashPrompt || args.v {
+		key := &requestKey{Provider: "bedrock", Model: *input.ModelId, Messages: keyMessages(input.Messages), ResponseFields: args.responseFields}
+		if key.Inference, err = inferenceConfig(args, *input.ModelId, args.t); err != nil {
+			return err
+		}
+		if done, err := reportHash(args, key); done || err != nil {
+			return err
 		}
 	}
-	if err != nil {
-		return err
-	}
-	var usage *types.TokenUsage
 	var buf bytes.Buffer
-	var wr io.Writer = os.Stdout
-	if args.web {
-		wr = io.MultiWriter(os.Stdout, &buf)
+	var wr io.Writer = args.out
+	var nd *ndjsonWriter
+	if args.format == "ndjson" {
+		nd = newNdjsonWriter(args.out)
+		wr = nd
+	}
+	if args.convertReply() {
+		wr = &buf
+	} else if args.web || len(args.sinks) != 0 {
+		wr = io.MultiWriter(wr, &buf)
+	}
+	textWr := wr
+	var stats textStats
+	if args.v {
+		textWr = io.MultiWriter(wr, &stats)
+	}
+	var shownModel string // the model last logged with -show-model
+	// ask sends request with temperature t and writes reply
+	ask := func(t *float32) (*responseMeta, error) {
+		var meta responseMeta
+		sendOnce := func() (iter.Seq2[string, error], error) {
+			meta.sent = time.Now()
+			if args.noStream {
+				out, err := cl.Converse(ctx, converseInput(input))
+				if err != nil {
+					return nil, err
+				}
+				return converseResponse(out, &meta), nil
+			}
+			out, err := cl.ConverseStream(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			return consumeResponse(out, &meta), nil
+		}
+		send := func() (iter.Seq2[string, error], error) {
+			chunks, err := sendOnce()
+			var ve *types.ValidationException
+			if input.PerformanceConfig != nil && errors.As(err, &ve) && latencyRejected(ve) {
+				log.Printf("model %s may not support latency-optimized inference in this region, ignoring -fast: %v", *input.ModelId, err)
+				input.PerformanceConfig = nil
+				return sendOnce()
+			}
+			return chunks, err
+		}
+		chunks, err := send()
+		var te *types.ThrottlingException
+		for i := range args.throttleRetries {
+			if args.onThrottle != "wait" || !errors.As(err, &te) {
+				break
+			}
+			delay := 10 * time.Second << i
+			log.Printf("all retries were throttled, trying again in %v", delay)
+			if args.retryLog != nil {
+				args.retryLog.Printf("bedrock: model %s throttled, trying again in %v: %v", *input.ModelId, delay, err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			chunks, err = send()
+		}
+		for _, modelId := range models[slices.Index(models, *input.ModelId)+1:] {
+			var me *types.ModelNotReadyException
+			if args.onThrottle == "fallback" && errors.As(err, &te) {
+				log.Printf("all retries were throttled, falling back to model %s", modelId)
+			} else if errors.As(err, &me) {
+				log.Printf("model %s is not ready, falling back to model %s", *input.ModelId, modelId)
+			} else {
+				break
+			}
+			input.ModelId = &modelId
+			// inference parameters from the config file may differ per model
+			if input.InferenceConfig, err = inferenceConfig(args, modelId, t); err != nil {
+				return nil, err
+			}
+			chunks, err = send()
+		}
+		var ve *types.ValidationException
+		if errors.As(err, &ve) && slices.ContainsFunc(contentBlocks, func(b types.ContentBlock) bool {
+			_, ok := b.(*types.ContentBlockMemberAudio)
+			return ok
+		}) {
+			return nil, fmt.Errorf("model %s does not support audio, or rejected audio attachment: %w", *input.ModelId, err)
+		}
+		if err != nil {
+			return nil, credentialsError(err, setup)
+		}
+		if (args.showModel || args.v) && *input.ModelId != shownModel {
+			shownModel = *input.ModelId
+			log.Printf("model: %s", shownModel)
+		}
+		limit := outputLimit{max: args.maxOutputBytes}
+		for chunk, err2 := range chunks {
+			chunk, ok := limit.take(chunk)
+			io.WriteString(textWr, chunk)
+			if !ok {
+				err = errOutputLimit
+				break
+			}
+			if err = err2; err != nil {
+				break
+			}
+		}
+		if nd != nil {
+			if err2 := nd.finish(string(meta.stopReason), meta.ndjsonUsage(), err); err == nil {
+				err = err2
+			}
+		} else {
+			io.WriteString(wr, "\n")
+		}
+		if args.v {
+			for _, tu := range meta.toolUses {
+				log.Printf("input of tool %s (id %s): %s", tu.name, tu.id, cmp.Or(tu.input, "{}"))
+			}
+		}
+		return &meta, err
 	}
-	for chunk, err := range consumeResponse(out, func(u *types.TokenUsage) { usage = u }) {
-		io.WriteString(wr, chunk)
+	temperatures := []*float32{args.t}
+	if len(args.tSweep) != 0 {
+		temperatures = temperatures[:0]
+		for i := range args.tSweep {
+			temperatures = append(temperatures, &args.tSweep[i])
+		}
+	}
+	// with -diff, each reply is collected separately, with its own
+	// configuration, and only their difference is written
+	var diffReplies []*bytes.Buffer
+	if len(args.diff) != 0 {
+		temperatures = temperatures[:0]
+		for i, d := range args.diff {
+			args.diff[i].model = cmp.Or(d.model, models[0])
+			if d.t == nil {
+				args.diff[i].t = args.t
+			}
+			temperatures = append(temperatures, args.diff[i].t)
+		}
+	}
+	// with -script, each of the following prompts continues the same
+	// conversation, so replies are collected to be sent back
+	var turnReply strings.Builder
+	if args.script {
+		temperatures = slices.Repeat(temperatures, len(turns))
+		textWr = io.MultiWriter(textWr, &turnReply)
+	}
+	var usage tokenUsage
+	var latencies []latency
+	var replyModels []string // models that made the reply, for -summary
+	for i, t := range temperatures {
+		if len(args.diff) != 0 {
+			// no fallback to other models, as it defeats the comparison
+			models = []string{args.diff[i].model}
+			input.ModelId = &models[0]
+			diffReplies = append(diffReplies, new(bytes.Buffer))
+			wr, textWr = diffReplies[i], diffReplies[i]
+			if args.v {
+				textWr = io.MultiWriter(wr, &stats)
+			}
+		}
+		if args.script {
+			if i != 0 {
+				if strings.TrimSpace(turnReply.String()) == "" {
+					return fmt.Errorf("reply to prompt %d is empty, can't continue the conversation", i)
+				}
+				input.Messages = append(input.Messages,
+					types.Message{Role: types.ConversationRoleAssistant, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: turnReply.String()}}},
+					types.Message{Role: types.ConversationRoleUser, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: turns[i]}}},
+				)
+				io.WriteString(wr, "\n")
+			}
+			turnReply.Reset()
+			fmt.Fprintf(wr, "## Prompt %d\n\n", i+1)
+		}
+		if input.InferenceConfig, err = inferenceConfig(args, *input.ModelId, t); err != nil {
+			return err
+		}
+		if len(args.tSweep) != 0 {
+			if i != 0 {
+				io.WriteString(wr, "\n")
+			}
+			fmt.Fprintf(wr, "## Temperature %g\n\n", *t)
+		}
+		stats.first = time.Time{}
+		paused := pausedFor(args.out)
+		meta, err := ask(t)
 		if err != nil {
+			if args.v {
+				// describe the part of the reply received before the failure
+				log.Print(stats.String())
+			}
+			if args.web && incompleteReply(err) && buf.Len() != 0 {
+				fmt.Fprintf(&buf, "\n---\n\n**The reply is incomplete:** %v\n", err)
+				if err := renderAndOpen(&buf, nil, args); err != nil {
+					log.Printf("rendering incomplete reply: %v", err)
+				}
+			}
+			return err
+		}
+		if !slices.Contains(replyModels, *input.ModelId) {
+			replyModels = append(replyModels, *input.ModelId)
+		}
+		if tu := meta.usage; tu != nil {
+			usage.add(int(aws.ToInt32(tu.InputTokens)), int(aws.ToInt32(tu.OutputTokens)), int(aws.ToInt32(tu.TotalTokens)))
+			if args.v && len(args.diff) != 0 {
+				log.Printf("tokens usage (%s): total: %d, input: %d, output: %d", args.diff[i],
+					aws.ToInt32(tu.TotalTokens), aws.ToInt32(tu.InputTokens), aws.ToInt32(tu.OutputTokens))
+			}
+		}
+		if args.v {
+			var outputTokens int
+			if meta.usage != nil {
+				outputTokens = int(aws.ToInt32(meta.usage.OutputTokens))
+			}
+			latencies = append(latencies, newLatency(meta.sent, stats.first, pausedFor(args.out)-paused, outputTokens))
+		}
+		if args.v && meta.responseFields != nil {
+			if b, err := meta.responseFields.MarshalSmithyDocument(); err == nil {
+				log.Printf("additional response fields: %s", b)
+			} else {
+				log.Printf("decoding additional response fields: %v", err)
+			}
+		}
+	}
+	if args.v && usage.seen {
+		log.Printf("tokens usage: total: %d, input: %d, output: %d", usage.total, usage.input, usage.output)
+	}
+	for _, l := range latencies {
+		log.Print(l)
+	}
+	if args.v {
+		log.Print(stats.String())
+	}
+	if args.summary {
+		logSummary(replyModels, started)
+	}
+	if len(diffReplies) == 2 {
+		differ, err := writeUnifiedDiff(args.out, args.diff[0].String(), args.diff[1].String(),
+			diffReplies[0].String(), diffReplies[1].String())
+		if err == nil && !differ {
+			log.Print("replies are the same")
+		}
+		return err
+	}
+	if args.footer != "" {
+		fmt.Fprintf(wr, "\n%s\n", footerText(args.footer, *input.ModelId, time.Now()))
+	}
+	if args.template != nil {
+		if err := writeTemplate(args.out, args.template, buf.String(), *input.ModelId, usage); err != nil {
+			return err
+		}
+	} else if args.convertReply() {
+		if err := writeConverted(args.out, buf.String(), args); err != nil {
 			return err
 		}
 	}
-	if args.v && usage != nil {
-		log.Printf("tokens usage: total: %d, input: %d, output: %d", *usage.TotalTokens, *usage.InputTokens, *usage.OutputTokens)
+	var info *replyInfo
+	if args.frontmatter {
+		info = &replyInfo{model: *input.ModelId, time: time.Now(), prompt: prompt, usage: usage}
+	}
+	if err := saveSinks(buf.Bytes(), args, info); err != nil {
+		return err
 	}
 	if args.web && buf.Len() != 0 {
-		return renderAndOpen(&buf)
+		return renderAndOpen(&buf, info, args)
 	}
 	return nil
 }
 
-func consumeResponse(cso *bedrockruntime.ConverseStreamOutput, usage func(*types.TokenUsage)) iter.Seq2[string, error] {
+// bedrockClient returns a Bedrock client configured from the "llmcli" AWS
+// profile if it exists, or from the default AWS configuration otherwise.
+// It also returns the description of the configuration used.
+// If retryLog is not nil, retries of failed requests are recorded to it.
+func bedrockClient(ctx context.Context, retryLog *log.Logger) (*bedrockruntime.Client, awsSetup, error) {
+	cfg, setup, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, setup, err
+	}
+	setup.endpoint = os.Getenv("LLMCLI_BEDROCK_ENDPOINT")
+	if setup.endpoint != "" {
+		if u, err := url.Parse(setup.endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, setup, fmt.Errorf("LLMCLI_BEDROCK_ENDPOINT must be an absolute url, got %q", setup.endpoint)
+		}
+	}
+	cl := bedrockruntime.NewFromConfig(cfg, func(o *bedrockruntime.Options) {
+		o.Retryer = retry.NewStandard(func(o *retry.StandardOptions) { o.MaxAttempts = 6 })
+		if retryLog != nil {
+			o.Retryer = &loggingRetryer{RetryerV2: o.Retryer.(aws.RetryerV2), log: retryLog}
+		}
+		if setup.endpoint != "" {
+			o.BaseEndpoint = &setup.endpoint
+		}
+	})
+	return cl, setup, nil
+}
+
+// loggingRetryer records every retry attempt the wrapped retryer makes.
+type loggingRetryer struct {
+	aws.RetryerV2
+	log *log.Logger
+}
+
+func (r *loggingRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	delay, err2 := r.RetryerV2.RetryDelay(attempt, err)
+	if err2 == nil {
+		r.log.Printf("bedrock: attempt %d failed, retrying in %v: %v", attempt, delay, err)
+	}
+	return delay, err2
+}
+
+// loadAWSConfig loads AWS configuration from the "llmcli" profile if it exists,
+// or the default one otherwise.
+func loadAWSConfig(ctx context.Context) (aws.Config, awsSetup, error) {
+	setup := awsSetup{profile: "llmcli"}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(setup.profile))
+	var e config.SharedConfigProfileNotExistError
+	if errors.As(err, &e) {
+		setup.profile = cmp.Or(os.Getenv("AWS_PROFILE"), "default")
+		cfg, err = config.LoadDefaultConfig(ctx)
+	}
+	setup.region = cfg.Region
+	setup.sso = usesSSO(cfg)
+	return cfg, setup, err
+}
+
+// usesSSO reports whether credentials of the shared config profile that cfg
+// was loaded from, or of its source profiles, come from AWS IAM Identity Center.
+func usesSSO(cfg aws.Config) bool {
+	for _, src := range cfg.ConfigSources {
+		sc, ok := src.(config.SharedConfig)
+		if !ok {
+			continue
+		}
+		for c := &sc; c != nil; c = c.Source {
+			if c.SSOSessionName != "" || c.SSOStartURL != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// awsSetup describes which AWS configuration Bedrock client was created with
+type awsSetup struct {
+	profile  string
+	region   string
+	endpoint string // custom endpoint, if any
+	sso      bool   // profile credentials come from SSO
+}
+
+// credentialsError checks whether err is caused by missing, invalid, or
+// expired AWS credentials, and if so, wraps it into an error with a hint on
+// how to fix that. Otherwise it returns err as is.
+func credentialsError(err error, setup awsSetup) error {
+	if err == nil {
+		return nil
+	}
+	profile, sso := setup.profile, setup.sso
+	var ite *ssocreds.InvalidTokenError
+	var ae smithy.APIError
+	switch {
+	case errors.As(err, &ite), strings.Contains(err.Error(), "cached SSO token is expired"):
+		return &awsCredentialsError{profile: profile, expired: true, sso: true, err: err}
+	case errors.As(err, &ae):
+		switch ae.ErrorCode() {
+		case "ExpiredTokenException", "ExpiredToken":
+			return &awsCredentialsError{profile: profile, expired: true, sso: sso, err: err}
+		case "UnrecognizedClientException", "InvalidSignatureException", "InvalidClientTokenId":
+			return &awsCredentialsError{profile: profile, err: err}
+		}
+	case strings.Contains(err.Error(), "failed to refresh cached credentials"):
+		return &awsCredentialsError{profile: profile, err: err}
+	}
+	return err
+}
+
+// awsCredentialsError is an error caused by AWS credentials problem, its
+// message suggests how to fix it. The original error is available with
+// errors.Unwrap.
+type awsCredentialsError struct {
+	profile string
+	expired bool
+	sso     bool // profile credentials come from SSO
+	err     error
+}
+
+func (e *awsCredentialsError) Error() string {
+	switch {
+	case e.expired && e.sso:
+		return fmt.Sprintf("AWS credentials expired; run 'aws sso login --profile %s'", e.profile)
+	case e.expired:
+		return fmt.Sprintf("AWS credentials expired; refresh credentials of the %q profile", e.profile)
+	}
+	return fmt.Sprintf("AWS credentials are missing or invalid; check the %q profile configuration", e.profile)
+}
+
+func (e *awsCredentialsError) Unwrap() error { return e.err }
+
+// latencyRejected reports whether the validation error is about the latency
+// or performance configuration of the request.
+func latencyRejected(err *types.ValidationException) bool {
+	msg := strings.ToLower(err.ErrorMessage())
+	return strings.Contains(msg, "latency") || strings.Contains(msg, "performance")
+}
+
+// fallbackModelId is the model to fall back to on throttling when there's no
+// LLMCLI_MODEL_CHAIN.
+const fallbackModelId = "anthropic.claude-3-sonnet-20240229-v1:0"
+
+// modelChain returns ids of models to try, in order of preference, from
+// LLMCLI_MODEL_CHAIN or model_chain of the config file. Without a chain, it is
+// the model from LLMCLI_MODEL or the config file, followed by fallbackModelId
+// if throttleFallback is true, or LLMCLI_FALLBACK_ON_THROTTLE is set.
+func (c *fileConfig) modelChain(throttleFallback bool) []string {
+	if s := configEnv("LLMCLI_MODEL_CHAIN", strings.Join(c.ModelChain, ",")); s != "" {
+		var models []string
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				models = append(models, modelAlias(name))
+			}
+		}
+		if len(models) != 0 {
+			return slices.Compact(models)
+		}
+	}
+	models := []string{modelAlias(cmp.Or(configEnv("LLMCLI_MODEL", c.Model), "anthropic.claude-3-5-sonnet-20240620-v1:0"))}
+	if ok, _ := strconv.ParseBool(os.Getenv("LLMCLI_FALLBACK_ON_THROTTLE")); (ok || throttleFallback) && models[0] != fallbackModelId {
+		models = append(models, fallbackModelId)
+	}
+	return models
+}
+
+func modelAlias(name string) string {
+	switch name {
+	case "haiku":
+		return "anthropic.claude-3-haiku-20240307-v1:0"
+	}
+	return name
+}
+
+// scriptSeparator is a line separating prompts of -script
+const scriptSeparator = "---"
+
+// splitScript splits text into prompts separated by scriptSeparator lines,
+// skipping empty ones.
+func splitScript(text string) []string {
+	var prompts []string
+	var sb strings.Builder
+	flush := func() {
+		if p := strings.TrimSpace(sb.String()); p != "" {
+			prompts = append(prompts, p)
+		}
+		sb.Reset()
+	}
+	for line := range strings.Lines(text) {
+		if strings.TrimSpace(line) == scriptSeparator {
+			flush()
+			continue
+		}
+		sb.WriteString(line)
+	}
+	flush()
+	return prompts
+}
+
+// estimateTokens returns a rough estimate of the number of input tokens of
+// the request: about 4 characters of text per token, and a fixed amount per
+// image or document.
+func estimateTokens(input *bedrockruntime.ConverseStreamInput) int {
+	const perAttachment = 1500
+	var chars, n int
+	for _, b := range input.System {
+		if tb, ok := b.(*types.SystemContentBlockMemberText); ok {
+			chars += utf8.RuneCountInString(tb.Value)
+		}
+	}
+	for _, msg := range input.Messages {
+		for _, b := range msg.Content {
+			switch b := b.(type) {
+			case *types.ContentBlockMemberText:
+				chars += utf8.RuneCountInString(b.Value)
+			default:
+				n += perAttachment
+			}
+		}
+	}
+	return n + chars/4
+}
+
+// checkImageCount returns an error listing attachments if there are more than
+// max images, as given by their names, one per image. Zero max means no limit.
+func checkImageCount(images []string, max int) error {
+	if max <= 0 || len(images) <= max {
+		return nil
+	}
+	return fmt.Errorf("%d images attached, more than the -max-images limit of %d: %s",
+		len(images), max, strings.Join(images, ", "))
+}
+
+// textStats counts characters and words in the text written to it.
+type textStats struct {
+	chars, words int
+	inWord       bool
+	first        time.Time // when the first non-empty text was written
+}
+
+func (s *textStats) Write(p []byte) (int, error) {
+	s.WriteString(string(p))
+	return len(p), nil
+}
+
+func (s *textStats) WriteString(text string) (int, error) {
+	if text != "" && s.first.IsZero() {
+		s.first = time.Now()
+	}
+	for _, r := range text {
+		s.chars++
+		if unicode.IsSpace(r) {
+			s.inWord = false
+		} else if !s.inWord {
+			s.inWord = true
+			s.words++
+		}
+	}
+	return len(text), nil
+}
+
+func (s *textStats) String() string { return fmt.Sprintf("chars: %d, words: %d", s.chars, s.words) }
+
+// outputLimit tracks the size of the reply, to stop it once it grows past max
+// bytes. Zero max means no limit.
+type outputLimit struct {
+	max, n int
+}
+
+// take returns the part of the reply chunk that fits within the limit, and
+// whether the whole chunk did.
+func (l *outputLimit) take(chunk string) (string, bool) {
+	if l.max <= 0 {
+		return chunk, true
+	}
+	if l.n+len(chunk) <= l.max {
+		l.n += len(chunk)
+		return chunk, true
+	}
+	i := max(l.max-l.n, 0)
+	for i > 0 && !utf8.RuneStart(chunk[i]) {
+		i--
+	}
+	l.n = l.max
+	return chunk[:i], false
+}
+
+var errOutputLimit = errors.New("reply exceeded -max-output-bytes limit, the rest of it was discarded")
+
+// pacedWriter pauses before each write but the first one, so that text
+// written to it in small chunks appears gradually.
+type pacedWriter struct {
+	w      io.Writer
+	delay  time.Duration
+	paused time.Duration // total time spent pausing
+	used   bool
+}
+
+func (p *pacedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if p.used {
+		time.Sleep(p.delay)
+		p.paused += p.delay
+	}
+	p.used = true
+	return p.w.Write(b)
+}
+
+// pausedFor returns how much time w spent pausing, if it's a *pacedWriter.
+func pausedFor(w io.Writer) time.Duration {
+	if p, ok := w.(*pacedWriter); ok {
+		return p.paused
+	}
+	return 0
+}
+
+// latency describes how fast the reply was produced
+type latency struct {
+	firstToken, total time.Duration
+	outputTokens      int
+}
+
+// newLatency returns latency of the request sent at the given time, with the
+// first text of reply arrived at first, and that is complete now. Time spent
+// paused by -stream-delay is not counted.
+func newLatency(sent, first time.Time, paused time.Duration, outputTokens int) latency {
+	l := latency{total: time.Since(sent) - paused, outputTokens: outputTokens}
+	l.firstToken = l.total
+	if !first.IsZero() {
+		l.firstToken = first.Sub(sent)
+	}
+	return l
+}
+
+func (l latency) String() string {
+	s := fmt.Sprintf("time to first token: %v, total: %v", l.firstToken.Round(time.Millisecond), l.total.Round(time.Millisecond))
+	if l.outputTokens != 0 && l.total > 0 {
+		s += fmt.Sprintf(", %.1f tokens/s", float64(l.outputTokens)/l.total.Seconds())
+	}
+	return s
+}
+
+// tokenUsage accumulates token usage over multiple requests
+type tokenUsage struct {
+	input, output, total int
+	seen                 bool // whether any usage was reported
+}
+
+func (u *tokenUsage) add(input, output, total int) {
+	u.seen = true
+	u.input += input
+	u.output += output
+	u.total += total
+}
+
+// responseMeta holds details about the reply that are not part of its text.
+type responseMeta struct {
+	usage      *types.TokenUsage
+	stopReason types.StopReason
+	sent       time.Time // when the request was sent
+	toolUses   []toolUse // tools model asked to call
+
+	// additional model-specific fields requested with -response-field
+	responseFields document.Interface
+}
+
+// toolUse describes model's request to call a tool
+type toolUse struct {
+	id, name string
+	input    string // json-encoded tool input
+}
+
+func (m *responseMeta) ndjsonUsage() *ndjsonUsage {
+	if m.usage == nil {
+		return nil
+	}
+	return &ndjsonUsage{
+		Input:  int(aws.ToInt32(m.usage.InputTokens)),
+		Output: int(aws.ToInt32(m.usage.OutputTokens)),
+		Total:  int(aws.ToInt32(m.usage.TotalTokens)),
+	}
+}
+
+func consumeResponse(cso *bedrockruntime.ConverseStreamOutput, meta *responseMeta) iter.Seq2[string, error] {
 	return func(yield func(string, error) bool) {
 		stream := cso.GetStream()
 		defer stream.Close()
+		var filtered types.StopReason // set if reply was stopped by content filter
+		var guardrail *types.GuardrailTraceAssessment
 		for evt := range stream.Events() {
 			switch v := evt.(type) {
 			case *types.ConverseStreamOutputMemberContentBlockDelta:
-				if d, ok := v.Value.Delta.(*types.ContentBlockDeltaMemberText); ok && !yield(d.Value, nil) {
-					return
+				switch d := v.Value.Delta.(type) {
+				case *types.ContentBlockDeltaMemberText:
+					if !yield(d.Value, nil) {
+						return
+					}
+				case *types.ContentBlockDeltaMemberToolUse:
+					if n := len(meta.toolUses); n != 0 {
+						meta.toolUses[n-1].input += aws.ToString(d.Value.Input)
+					}
+				}
+			case *types.ConverseStreamOutputMemberContentBlockStart:
+				switch st := v.Value.Start.(type) {
+				case *types.ContentBlockStartMemberToolUse:
+					tu := toolUse{id: aws.ToString(st.Value.ToolUseId), name: aws.ToString(st.Value.Name)}
+					log.Printf("model requested to use tool %s (id %s)", tu.name, tu.id)
+					meta.toolUses = append(meta.toolUses, tu)
+				default:
+					log.Printf("content block of unsupported type %T started", st)
 				}
 			case *types.ConverseStreamOutputMemberContentBlockStop:
 			case *types.ConverseStreamOutputMemberMessageStart:
 			case *types.ConverseStreamOutputMemberMessageStop:
-				if !yield("\n", nil) {
-					return
-				}
-				if s := v.Value.StopReason; s != types.StopReasonEndTurn {
-					_ = yield("", fmt.Errorf("stop reason: %s", s))
+				meta.stopReason = v.Value.StopReason
+				meta.responseFields = v.Value.AdditionalModelResponseFields
+				switch s := v.Value.StopReason; s {
+				case types.StopReasonEndTurn, types.StopReasonStopSequence:
+				case types.StopReasonContentFiltered, types.StopReasonGuardrailIntervened:
+					// the following metadata event may carry the reason
+					filtered = s
+				default:
+					_ = yield("", stopReasonError(s, nil))
 					return
 				}
 			case *types.ConverseStreamOutputMemberMetadata:
-				usage(v.Value.Usage)
+				meta.usage = v.Value.Usage
+				if v.Value.Trace != nil {
+					guardrail = v.Value.Trace.Guardrail
+				}
 			default:
 				log.Printf("unknown event type %T: %+v", evt, evt)
 			}
 		}
-		if err := stream.Err(); err != nil {
-			yield("", err)
+		if err := stream.Err(); err != nil {
+			yield("", err)
+			return
+		}
+		if filtered != "" {
+			yield("", stopReasonError(filtered, guardrail))
+		}
+	}
+}
+
+// converseInput translates streaming request into its non-streaming variant.
+func converseInput(in *bedrockruntime.ConverseStreamInput) *bedrockruntime.ConverseInput {
+	return &bedrockruntime.ConverseInput{
+		ModelId:                           in.ModelId,
+		Messages:                          in.Messages,
+		System:                            in.System,
+		InferenceConfig:                   in.InferenceConfig,
+		ToolConfig:                        in.ToolConfig,
+		AdditionalModelRequestFields:      in.AdditionalModelRequestFields,
+		AdditionalModelResponseFieldPaths: in.AdditionalModelResponseFieldPaths,
+		PerformanceConfig:                 in.PerformanceConfig,
+		RequestMetadata:                   in.RequestMetadata,
+	}
+}
+
+// converseResponse presents a complete reply to non-streaming request the same
+// way as consumeResponse does for streaming requests.
+func converseResponse(out *bedrockruntime.ConverseOutput, meta *responseMeta) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		meta.usage = out.Usage
+		meta.stopReason = out.StopReason
+		meta.responseFields = out.AdditionalModelResponseFields
+		if msg, ok := out.Output.(*types.ConverseOutputMemberMessage); ok {
+			for _, block := range msg.Value.Content {
+				switch v := block.(type) {
+				case *types.ContentBlockMemberText:
+					if !yield(v.Value, nil) {
+						return
+					}
+				case *types.ContentBlockMemberToolUse:
+					tu := toolUse{id: aws.ToString(v.Value.ToolUseId), name: aws.ToString(v.Value.Name)}
+					if v.Value.Input != nil {
+						if b, err := v.Value.Input.MarshalSmithyDocument(); err == nil {
+							tu.input = string(b)
+						}
+					}
+					log.Printf("model requested to use tool %s (id %s)", tu.name, tu.id)
+					meta.toolUses = append(meta.toolUses, tu)
+				}
+			}
+		}
+		if s := out.StopReason; s != types.StopReasonEndTurn && s != types.StopReasonStopSequence {
+			var guardrail *types.GuardrailTraceAssessment
+			if out.Trace != nil {
+				guardrail = out.Trace.Guardrail
+			}
+			yield("", stopReasonError(s, guardrail))
+		}
+	}
+}
+
+// stopReasonError returns an error describing why the reply was stopped
+// before the end of the turn: a *contentFilterError if it was blocked by
+// content filter or guardrail, whose trace may give the reason.
+func stopReasonError(s types.StopReason, guardrail *types.GuardrailTraceAssessment) error {
+	switch s {
+	case types.StopReasonContentFiltered, types.StopReasonGuardrailIntervened:
+		e := &contentFilterError{stopReason: string(s)}
+		if guardrail != nil {
+			e.reason = aws.ToString(guardrail.ActionReason)
 		}
+		return e
+	case types.StopReasonMaxTokens:
+		return errMaxTokens
+	}
+	return fmt.Errorf("stop reason: %s", s)
+}
+
+var errMaxTokens = errors.New("stop reason: max_tokens")
+
+// incompleteReply reports whether err only means that the reply was cut
+// short, so the part of it received so far is still worth showing.
+func incompleteReply(err error) bool {
+	return errors.Is(err, errMaxTokens) || errors.Is(err, errOutputLimit)
+}
+
+// contentFilterError is returned when reply is blocked by provider's content
+// filter. Program exits with exitContentFiltered code on such error.
+type contentFilterError struct {
+	stopReason string
+	reason     string // optional explanation given by the filter
+}
+
+func (e *contentFilterError) Error() string {
+	if e.reason != "" {
+		return fmt.Sprintf("reply was blocked by content filter (stop reason: %s): %s", e.stopReason, e.reason)
 	}
+	return fmt.Sprintf("reply was blocked by content filter (stop reason: %s)", e.stopReason)
 }
 
+// exitContentFiltered is the exit code used when reply is blocked by content
+// filter, so that scripts can tell it from other errors
+const exitContentFiltered = 3
+
 func readPrompt(args runArgs) (string, error) {
 	var stdinIsTerminal bool
 	if st, err := os.Stdin.Stat(); err == nil {
@@ -227,48 +1743,281 @@ func readPrompt(args runArgs) (string, error) {
 	var pb strings.Builder
 	var stdinData []byte
 	var err error
-	if stdinIsTerminal && args.q == "" {
+	if args.paste {
+		// clipboard text takes place of stdin, and is not read
+		stdinIsTerminal = false
+		if !args.clipboardImage {
+			stdinData = args.clipboard
+		}
+		if !utf8.Valid(stdinData) {
+			return "", errors.New("clipboard text is not a valid utf8")
+		}
+	}
+	// editor integrations may attach stdin to a pseudo-terminal, and don't
+	// need the hints cluttering their buffers
+	quiet, _ := strconv.ParseBool(os.Getenv("LLMCLI_QUIET"))
+	readStdin := !args.paste && !args.noStdin && (!stdinIsTerminal || args.q == "" && !args.att.bare || args.forceStdin)
+	hints := readStdin && stdinIsTerminal && !quiet
+	if hints {
 		log.Println("Please type your prompt, when done, submit with ^D")
 	}
-	if !stdinIsTerminal || (stdinIsTerminal && args.q == "") {
+	if readStdin {
 		stdinData, err = io.ReadAll(os.Stdin)
 	}
 	if err != nil {
 		return "", err
 	}
 	if len(bytes.TrimSpace(stdinData)) == 0 && args.q == "" {
+		if args.att.bare {
+			// the attachment becomes the prompt
+			return "", nil
+		}
 		return "", errors.New("empty prompt: please feed it over stdin and/or use the -q flag")
 	}
 	if !utf8.Valid(stdinData) {
 		return "", errors.New("can only take valid utf8 data on stdin")
 	}
-	switch args.q {
+	if args.qFirstLine {
+		// the first non-blank line becomes the prompt, the rest is data
+		text := string(stdinData)
+		for args.q == "" && text != "" {
+			var line string
+			line, text, _ = strings.Cut(text, "\n")
+			args.q = strings.TrimSpace(line)
+		}
+		stdinData = []byte(text)
+	}
+	stdinText, q := string(stdinData), args.q
+	if args.includes {
+		var err error
+		if stdinText, err = expandIncludes(stdinText, "stdin", nil); err != nil {
+			return "", err
+		}
+		if q, err = expandIncludes(q, "prompt", nil); err != nil {
+			return "", err
+		}
+	}
+	switch q {
 	case "":
-		pb.Write(stdinData)
+		pb.WriteString(stdinText)
 	default:
-		if len(bytes.TrimSpace(stdinData)) != 0 {
+		if len(strings.TrimSpace(stdinText)) != 0 {
 			pb.WriteString(tagDocOpen)
-			pb.Write(stdinData)
+			pb.WriteString(stdinText)
 			pb.WriteString(tagDocClose)
 			pb.WriteByte('\n')
 		}
-		pb.WriteString(args.q)
+		pb.WriteString(q)
 	}
-	if stdinIsTerminal && args.q == "" {
+	if hints {
 		log.Println("end of prompt")
 	}
 	return pb.String(), nil
 }
 
-func contentBlockFromFile(p string) (types.ContentBlock, error) {
+// expandIncludes replaces lines of the form "@include path" in text with the
+// contents of the referenced files, wrapped within <document> tags. Included
+// files may include other files; relative paths are resolved against the
+// directory of the including file. Source names the text in error messages,
+// stack holds absolute paths of files being expanded.
+func expandIncludes(text, source string, stack []string) (string, error) {
+	const directive = "@include "
+	if !strings.Contains(text, directive) {
+		return text, nil
+	}
+	const maxDepth = 10
+	var sb strings.Builder
+	for i, line := range strings.SplitAfter(text, "\n") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(line), directive)
+		if !ok {
+			sb.WriteString(line)
+			continue
+		}
+		if name = strings.TrimSpace(name); len(stack) != 0 && !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(stack[len(stack)-1]), name)
+		}
+		p, err := filepath.Abs(name)
+		if err != nil {
+			return "", fmt.Errorf("%s:%d: %w", source, i+1, err)
+		}
+		if slices.Contains(stack, p) {
+			return "", fmt.Errorf("%s:%d: %s includes itself", source, i+1, name)
+		}
+		if len(stack) == maxDepth {
+			return "", fmt.Errorf("%s:%d: includes are nested deeper than %d levels", source, i+1, maxDepth)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("%s:%d: %w", source, i+1, err)
+		}
+		if !utf8.Valid(b) {
+			return "", fmt.Errorf("%s:%d: %s is not a valid utf8", source, i+1, name)
+		}
+		body, err := expandIncludes(string(b), name, append(stack, p))
+		if err != nil {
+			return "", err
+		}
+		sb.Write(appendDocument(nil, "document", "", filepath.Base(p), []byte(body)))
+	}
+	return sb.String(), nil
+}
+
+// appendDocument appends text wrapped within tag (normally "document") to dst,
+// with the file name put inside <filename> tags at the start. Non-empty attrs
+// are put inside the opening tag as is, and must start with a space.
+func appendDocument(dst []byte, tag, attrs, filename string, text []byte) []byte {
+	dst = append(dst, '<')
+	dst = append(dst, tag...)
+	dst = append(dst, attrs...)
+	dst = append(dst, '>')
+	dst = append(dst, "<filename>"...)
+	dst = append(dst, filename...)
+	dst = append(dst, "</filename>\n"...)
+	dst = append(dst, text...)
+	if dst[len(dst)-1] != '\n' {
+		dst = append(dst, '\n')
+	}
+	dst = append(dst, "</"...)
+	dst = append(dst, tag...)
+	return append(dst, ">\n"...)
+}
+
+// example is a single few-shot example: a user message and the expected reply
+type example struct {
+	user, assistant string
+}
+
+// loadExamples loads few-shot examples from dir, which must hold pairs of
+// NNN.user.txt and NNN.assistant.txt files, where NNN is a number defining
+// the order of examples.
+func loadExamples(dir string) ([]example, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byNum := make(map[int]*example)
+	for _, ent := range entries {
+		name := ent.Name()
+		num, role, ok := strings.Cut(strings.TrimSuffix(name, ".txt"), ".")
+		if !ent.Type().IsRegular() || !strings.HasSuffix(name, ".txt") || !ok {
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil || (role != "user" && role != "assistant") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 || !utf8.Valid(b) {
+			return nil, fmt.Errorf("example file %s is empty or not a valid utf8", filepath.Join(dir, name))
+		}
+		ex := byNum[n]
+		if ex == nil {
+			ex = &example{}
+			byNum[n] = ex
+		}
+		if role == "user" {
+			ex.user = string(b)
+		} else {
+			ex.assistant = string(b)
+		}
+	}
+	if len(byNum) == 0 {
+		return nil, fmt.Errorf("no examples found in %s", dir)
+	}
+	var out []example
+	for _, n := range slices.Sorted(maps.Keys(byNum)) {
+		ex := byNum[n]
+		if ex.user == "" || ex.assistant == "" {
+			return nil, fmt.Errorf("example %d in %s must have both user and assistant files", n, dir)
+		}
+		out = append(out, *ex)
+	}
+	return out, nil
+}
+
+func contentBlockFromFile(p string, opts blockOptions) ([]types.ContentBlock, error) {
 	b, err := os.ReadFile(p)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) > 50<<20 {
+	if len(b) > maxDocumentSize {
 		return nil, errors.New("maximum document size supported is 50Mb")
 	}
-	ct := http.DetectContentType(b)
+	if opts.codeContext {
+		if st, err := os.Stat(p); err == nil {
+			opts.modTime = st.ModTime()
+		}
+	}
+	return contentBlockFromBytes(p, b, http.DetectContentType(b), opts)
+}
+
+const maxDocumentSize = 50 << 20
+
+// docFormats maps file extensions to formats of documents
+var docFormats = map[string]types.DocumentFormat{
+	".pdf":  types.DocumentFormatPdf,
+	".md":   types.DocumentFormatMd,
+	".mkd":  types.DocumentFormatMd,
+	".html": types.DocumentFormatHtml,
+	".doc":  types.DocumentFormatDoc,
+	".docx": types.DocumentFormatDocx,
+	".csv":  types.DocumentFormatCsv,
+	".txt":  types.DocumentFormatTxt,
+}
+
+// loadExtensions loads extensions.json from the llmcli config directory, an
+// object mapping file extensions to document formats, such as
+// {".rst": "txt"}. These take precedence over docFormats. Problems with the
+// file are logged, and invalid entries ignored.
+func loadExtensions() map[string]types.DocumentFormat {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+	name := filepath.Join(configDir, "llmcli", "extensions.json")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("ignoring %s: %v", name, err)
+		}
+		return nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Printf("ignoring %s: %v", name, err)
+		return nil
+	}
+	formats := make(map[string]types.DocumentFormat, len(m))
+	for ext, format := range m {
+		if !slices.Contains(types.DocumentFormat("").Values(), types.DocumentFormat(format)) {
+			log.Printf("%s: ignoring unsupported format %q for extension %q", name, format, ext)
+			continue
+		}
+		if ext = strings.ToLower(ext); !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		formats[ext] = types.DocumentFormat(format)
+	}
+	return formats
+}
+
+// contentBlockFromBytes converts b, the content of file p of content-type ct,
+// into content blocks.
+func contentBlockFromBytes(p string, b []byte, ct string, opts blockOptions) ([]types.ContentBlock, error) {
+	// svg is text, and not an image format models take
+	rasterImage := func(t string) bool { return strings.HasPrefix(t, "image/") && !strings.HasPrefix(t, "image/svg+xml") }
+	if opts.imageFormat != "" && (rasterImage(ct) || rasterImage(mime.TypeByExtension(filepath.Ext(p)))) {
+		return []types.ContentBlock{&types.ContentBlockMemberImage{
+			Value: types.ImageBlock{Format: opts.imageFormat, Source: &types.ImageSourceMemberBytes{Value: b}},
+		}}, nil
+	}
 	if strings.HasPrefix(ct, "image/") {
 		block := &types.ContentBlockMemberImage{
 			Value: types.ImageBlock{Source: &types.ImageSourceMemberBytes{Value: b}},
@@ -285,37 +2034,33 @@ func contentBlockFromFile(p string) (types.ContentBlock, error) {
 		default:
 			return nil, fmt.Errorf("file %s is of unsupported content-type %s", p, ct)
 		}
-		return block, nil
+		return []types.ContentBlock{block}, nil
+	}
+	if format, ok := audioFormat(p, ct); ok {
+		return []types.ContentBlock{&types.ContentBlockMemberAudio{
+			Value: types.AudioBlock{Format: format, Source: &types.AudioSourceMemberBytes{Value: b}},
+		}}, nil
 	}
 
 	docName := strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+	if opts.numbered {
+		docName = fmt.Sprintf("Document %d %s", opts.index, docName)
+	}
 	block := &types.ContentBlockMemberDocument{
 		Value: types.DocumentBlock{
 			Source: &types.DocumentSourceMemberBytes{Value: b},
 			Name:   &docName,
 		},
 	}
-	switch strings.ToLower(filepath.Ext(p)) {
-	case ".pdf":
-		block.Value.Format = types.DocumentFormatPdf
-	case ".md", ".mkd":
-		block.Value.Format = types.DocumentFormatMd
-	case ".html":
-		block.Value.Format = types.DocumentFormatHtml
-	case ".doc":
-		block.Value.Format = types.DocumentFormatDoc
-	case ".docx":
-		block.Value.Format = types.DocumentFormatDocx
-	case ".csv":
-		block.Value.Format = types.DocumentFormatCsv
-	case ".txt":
+	ext := strings.ToLower(filepath.Ext(p))
+	if format, ok := opts.extFormats[ext]; ok {
+		block.Value.Format = format
+	} else if format, ok := docFormats[ext]; ok {
+		block.Value.Format = format
+	} else if ct == "text/plain; charset=utf-8" {
 		block.Value.Format = types.DocumentFormatTxt
-	default:
-		if ct == "text/plain; charset=utf-8" {
-			block.Value.Format = types.DocumentFormatTxt
-		} else {
-			return nil, fmt.Errorf("file %s is of unsupported content-type %s", p, ct)
-		}
+	} else {
+		return nil, fmt.Errorf("file %s is of unsupported content-type %s", p, ct)
 	}
 	// If the attachment looks like a plain text, change it from the attachment
 	// block into the text part of the prompt, wrapped within <document> tags.
@@ -327,19 +2072,221 @@ func contentBlockFromFile(p string) (types.ContentBlock, error) {
 	switch block.Value.Format {
 	case types.DocumentFormatMd, types.DocumentFormatTxt, types.DocumentFormatCsv:
 		if utf8.Valid(b) {
-			text := []byte(tagDocOpen[:len(tagDocOpen)-1]) // without the trailing newline
-			text = append(text, "<filename>"...)
-			text = append(text, filepath.Base(p)...)
-			text = append(text, "</filename>\n"...)
-			text = append(text, b...)
-			if text[len(text)-1] != '\n' {
-				text = append(text, '\n')
+			if opts.scan {
+				warnInjections(p, b)
+			}
+			header := opts.codeHeader(p, b)
+			if opts.lineNumbers {
+				b = numberLines(b)
+			}
+			if header != nil {
+				b = append(header, b...)
+			}
+			if opts.bare {
+				return []types.ContentBlock{&types.ContentBlockMemberText{Value: string(b)}}, nil
+			}
+			return textDocumentBlocks(opts.docTag(block.Value.Format), filepath.Base(p), b, opts), nil
+		}
+	}
+	return []types.ContentBlock{block}, nil
+}
+
+// codeLanguages maps extensions of source files to their languages.
+var codeLanguages = map[string]string{
+	".go":    "Go",
+	".py":    "Python",
+	".js":    "JavaScript",
+	".mjs":   "JavaScript",
+	".ts":    "TypeScript",
+	".tsx":   "TypeScript",
+	".jsx":   "JavaScript",
+	".rs":    "Rust",
+	".c":     "C",
+	".h":     "C",
+	".cc":    "C++",
+	".cpp":   "C++",
+	".hpp":   "C++",
+	".java":  "Java",
+	".kt":    "Kotlin",
+	".swift": "Swift",
+	".rb":    "Ruby",
+	".php":   "PHP",
+	".cs":    "C#",
+	".sh":    "Shell",
+	".bash":  "Shell",
+	".sql":   "SQL",
+	".lua":   "Lua",
+	".zig":   "Zig",
+}
+
+// codeHeader returns the <code-context> header describing source file p with
+// the content b, or nil if opts.codeContext is not set or p is not a known
+// kind of source file.
+func (o blockOptions) codeHeader(p string, b []byte) []byte {
+	lang, ok := codeLanguages[strings.ToLower(filepath.Ext(p))]
+	if !o.codeContext || !ok {
+		return nil
+	}
+	lines := bytes.Count(b, []byte("\n"))
+	if len(b) != 0 && b[len(b)-1] != '\n' {
+		lines++
+	}
+	header := fmt.Appendf(nil, "<code-context>\nlanguage: %s\nlines: %d\n", lang, lines)
+	if !o.modTime.IsZero() {
+		header = fmt.Appendf(header, "modified: %s\n", o.modTime.Format(time.RFC3339))
+	}
+	return append(header, "</code-context>\n"...)
+}
+
+// textDocumentBlocks wraps text within tag as a single text block. If text is
+// longer than opts.splitChars characters, it is split into several blocks,
+// each marked with a part="N/M" attribute.
+func textDocumentBlocks(tag, filename string, text []byte, opts blockOptions) []types.ContentBlock {
+	if opts.splitChars <= 0 || utf8.RuneCount(text) <= opts.splitChars {
+		return []types.ContentBlock{&types.ContentBlockMemberText{Value: string(appendDocument(nil, tag, opts.docAttrs(), filename, text))}}
+	}
+	parts := splitText(text, opts.splitChars)
+	blocks := make([]types.ContentBlock, 0, len(parts))
+	for i, part := range parts {
+		attrs := opts.docAttrs() + fmt.Sprintf(" part=\"%d/%d\"", i+1, len(parts))
+		blocks = append(blocks, &types.ContentBlockMemberText{Value: string(appendDocument(nil, tag, attrs, filename, part))})
+	}
+	return blocks
+}
+
+// splitText splits utf8 text into chunks of at most n characters each. Where
+// possible, chunks are cut right after a newline.
+func splitText(text []byte, n int) [][]byte {
+	var out [][]byte
+	for len(text) > 0 {
+		// find the byte offset right after the n-th character
+		end, count := 0, 0
+		for end < len(text) && count < n {
+			_, size := utf8.DecodeRune(text[end:])
+			end += size
+			count++
+		}
+		if end < len(text) {
+			if i := bytes.LastIndexByte(text[:end], '\n'); i > 0 {
+				end = i + 1
 			}
-			text = append(text, tagDocClose...)
-			return &types.ContentBlockMemberText{Value: string(text)}, nil
 		}
+		out = append(out, text[:end])
+		text = text[end:]
+	}
+	return out
+}
+
+// numberLines returns a copy of text with each line prefixed by its
+// right-aligned number.
+func numberLines(text []byte) []byte {
+	lines := bytes.SplitAfter(text, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	width := len(strconv.Itoa(len(lines)))
+	out := make([]byte, 0, len(text)+len(lines)*(width+2))
+	for i, line := range lines {
+		out = fmt.Appendf(out, "%*d  ", width, i+1)
+		out = append(out, line...)
+	}
+	return out
+}
+
+// audioFormat reports whether file p with detected content-type ct is an
+// audio file, and its format.
+func audioFormat(p, ct string) (types.AudioFormat, bool) {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".mp3":
+		return types.AudioFormatMp3, true
+	case ".wav":
+		return types.AudioFormatWav, true
+	case ".flac":
+		return types.AudioFormatFlac, true
+	case ".ogg", ".oga":
+		return types.AudioFormatOgg, true
+	case ".opus":
+		return types.AudioFormatOpus, true
+	case ".aac":
+		return types.AudioFormatAac, true
+	case ".m4a":
+		return types.AudioFormatM4a, true
+	}
+	switch ct {
+	case "audio/mpeg":
+		return types.AudioFormatMp3, true
+	case "audio/wave":
+		return types.AudioFormatWav, true
+	}
+	return "", false
+}
+
+// commandOutputBlock runs command with the shell and returns its combined
+// stdout and stderr output as a text block. Command exiting with non-zero
+// status is not considered an error, its exit code is included in the block.
+func commandOutputBlock(ctx context.Context, command string) (types.ContentBlock, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd.exe", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	b, err := cmd.CombinedOutput()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		return nil, fmt.Errorf("running %q: %w", command, err)
+	}
+	if !utf8.Valid(b) {
+		return nil, fmt.Errorf("command %q output is not a valid utf8", command)
+	}
+	text := []byte(tagDocOpen[:len(tagDocOpen)-1]) // without the trailing newline
+	text = append(text, "<command>"...)
+	text = append(text, command...)
+	text = append(text, "</command>\n"...)
+	text = append(text, b...)
+	if text[len(text)-1] != '\n' {
+		text = append(text, '\n')
+	}
+	if ee != nil {
+		text = fmt.Appendf(text, "<exit-code>%d</exit-code>\n", ee.ExitCode())
+	}
+	text = append(text, tagDocClose...)
+	return &types.ContentBlockMemberText{Value: string(text)}, nil
+}
+
+// gitDiffBlock returns changes of the git working tree in the current
+// directory since ref as a text block, wrapped within <document> tags marked
+// with type="git-diff" and the ref.
+func gitDiffBlock(ctx context.Context, ref string) (types.ContentBlock, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, errors.New("-since-commit needs git, but it's not found")
 	}
-	return block, nil
+	if err := exec.CommandContext(ctx, "git", "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		return nil, errors.New("-since-commit only works within a git working tree, and the current directory is not")
+	}
+	if err := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}").Run(); err != nil {
+		return nil, fmt.Errorf("-since-commit: %q is not a valid commit reference", ref)
+	}
+	cmd := exec.CommandContext(ctx, "git", "diff", ref, "--")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %v: %w: %s", cmd, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, fmt.Errorf("-since-commit: there are no changes since %s", ref)
+	}
+	if !utf8.Valid(b) {
+		return nil, fmt.Errorf("git diff %s output is not a valid utf8", ref)
+	}
+	text := fmt.Appendf(nil, "<document type=\"git-diff\" since=\"%s\">\n", html.EscapeString(ref))
+	text = append(text, b...)
+	if text[len(text)-1] != '\n' {
+		text = append(text, '\n')
+	}
+	text = append(text, tagDocClose...)
+	return &types.ContentBlockMemberText{Value: string(text)}, nil
 }
 
 func loadHandlers() *attHandlers {
@@ -364,47 +2311,182 @@ type attHandlers struct {
 }
 
 type attMatch struct {
-	Prefix string   `json:"prefix"`
-	Cmd    []string `json:"cmd"`
+	Prefix     string   `json:"prefix"`
+	Cmd        []string `json:"cmd"`
+	OutputType string   `json:"output_type"` // "text" (default), "image", or "binary"
+	StdinFile  bool     `json:"stdin_file"`  // pass the file over stdin instead of its name as an argument
 }
 
-func (h *attHandlers) attToBlock(ctx context.Context, name string) (types.ContentBlock, error) {
+func (h *attHandlers) attToBlock(ctx context.Context, name string, opts blockOptions) ([]types.ContentBlock, error) {
 	if h == nil {
-		return contentBlockFromFile(name)
+		return fileOrObjectToBlock(ctx, name, opts)
 	}
 	for _, m := range h.byPrefix {
 		if m.Prefix == "" || len(m.Cmd) == 0 || !strings.HasPrefix(name, m.Prefix) {
 			continue
 		}
-		args := append([]string{}, m.Cmd[1:]...)
+		var args []string
 		var found bool
-		for i := range args {
-			if args[i] == "${ARG}" {
-				args[i] = name
+		for _, arg := range m.Cmd[1:] {
+			switch {
+			case found:
+				args = append(args, arg)
+			case arg == "${ARG}":
+				args = append(args, name)
 				found = true
-				break
+			case arg == "${ARGS}":
+				fields, err := splitArgs(name)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				args = append(args, fields...)
+				found = true
+			default:
+				args = append(args, arg)
 			}
 		}
-		if !found {
+		if !found && !m.StdinFile {
 			args = append(args, name)
 		}
 		cmd := exec.CommandContext(ctx, m.Cmd[0], args...)
-		b, err := cmd.Output()
+		if m.StdinFile {
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			cmd.Stdin = f
+		}
+		b, err := commandOutput(cmd)
 		if err != nil {
 			return nil, fmt.Errorf("running %v: %w", cmd, err)
 		}
+		switch m.OutputType {
+		case "", "text":
+		case "image":
+			if ct := http.DetectContentType(b); strings.HasPrefix(ct, "image/") {
+				return contentBlockFromBytes(name, b, ct, opts)
+			}
+			return nil, fmt.Errorf("command %v output is not an image", cmd)
+		case "binary":
+			return contentBlockFromBytes(name, b, http.DetectContentType(b), opts)
+		default:
+			return nil, fmt.Errorf("att-handler for prefix %q has unsupported output_type %q", m.Prefix, m.OutputType)
+		}
 		if !utf8.Valid(b) {
 			return nil, fmt.Errorf("command %v output is not a valid utf8", cmd)
 		}
-		text := []byte(tagDocOpen)
+		if opts.scan {
+			warnInjections(name, b)
+		}
+		text := []byte(tagDocOpen[:len(tagDocOpen)-2]) // without the trailing ">\n"
+		text = append(text, opts.docAttrs()...)
+		text = append(text, ">\n"...)
 		text = append(text, b...)
 		if text[len(text)-1] != '\n' {
 			text = append(text, '\n')
 		}
 		text = append(text, tagDocClose...)
-		return &types.ContentBlockMemberText{Value: string(text)}, nil
+		return []types.ContentBlock{&types.ContentBlockMemberText{Value: string(text)}}, nil
+	}
+	return fileOrObjectToBlock(ctx, name, opts)
+}
+
+// splitArgs splits s into arguments on spaces, the way a shell does for
+// simple cases: text within single or double quotes, and a space escaped with
+// a backslash, are kept within the same argument, like in
+// "convert 'My Notes.pdf'" or "convert My\ Notes.pdf".
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	var inArg, escaped bool
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
 	}
-	return contentBlockFromFile(name)
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// commandOutput runs cmd and returns its standard output. It stops the
+// command and fails if the output is larger than maxDocumentSize. If the
+// command fails, the start of its standard error is kept in the Stderr field of
+// the returned *exec.ExitError, as with cmd.Output.
+func commandOutput(cmd *exec.Cmd) ([]byte, error) {
+	stderr := &cappedBuffer{max: 64 << 10}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(io.LimitReader(stdout, maxDocumentSize+1))
+	if err == nil && len(b) > maxDocumentSize {
+		cmd.Process.Kill()
+		err = errors.New("maximum document size supported is 50Mb")
+	}
+	if err != nil {
+		cmd.Wait()
+		return nil, err
+	}
+	err = cmd.Wait()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		ee.Stderr = stderr.Bytes()
+	}
+	return b, err
+}
+
+// cappedBuffer keeps up to max bytes written to it, and discards the rest.
+type cappedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - len(b.buf); n > 0 {
+		b.buf = append(b.buf, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) Bytes() []byte { return b.buf }
+
+// fileOrObjectToBlock converts either a local file, or an S3 object given as
+// s3://bucket/key into content blocks.
+func fileOrObjectToBlock(ctx context.Context, name string, opts blockOptions) ([]types.ContentBlock, error) {
+	if strings.HasPrefix(name, "s3://") {
+		return contentBlockFromS3(ctx, name, opts)
+	}
+	return contentBlockFromFile(name, opts)
 }
 
 const (
@@ -412,26 +2494,151 @@ const (
 	tagDocClose = "</document>\n"
 )
 
-// renderAndOpen converts Markdown content to HTML and opens it in the default browser.
-func renderAndOpen(buf *bytes.Buffer) error {
+// inferenceConfig merges inference parameters for the model from the config
+// file, -infer flag, and temperature t, in the order of increasing priority,
+// and validates the result. It returns nil if no parameters are set.
+func inferenceConfig(args runArgs, model string, t *float32) (*types.InferenceConfiguration, error) {
+	d := args.config.modelDefaults(model)
+	c := types.InferenceConfiguration{Temperature: d.Temperature, MaxTokens: d.MaxTokens, TopP: d.TopP}
+	if b := args.infer; b != nil {
+		c.Temperature = cmp.Or(b.Temperature, c.Temperature)
+		c.MaxTokens = cmp.Or(b.MaxTokens, c.MaxTokens)
+		c.TopP = cmp.Or(b.TopP, c.TopP)
+		c.StopSequences = b.StopSequences
+	}
+	c.Temperature = cmp.Or(t, c.Temperature)
+	switch {
+	case c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 1):
+		return nil, fmt.Errorf("temperature %g is out of [0, 1] range", *c.Temperature)
+	case c.TopP != nil && (*c.TopP < 0 || *c.TopP > 1):
+		return nil, fmt.Errorf("topP %g is out of [0, 1] range", *c.TopP)
+	case c.MaxTokens != nil && *c.MaxTokens < 1:
+		return nil, fmt.Errorf("maxTokens %d must be positive", *c.MaxTokens)
+	case slices.Contains(c.StopSequences, ""):
+		return nil, errors.New("stopSequences must not contain empty strings")
+	}
+	if c.Temperature == nil && c.MaxTokens == nil && c.TopP == nil && len(c.StopSequences) == 0 {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// renderAndOpen converts Markdown content to HTML using args.md parser and
+// opens it in the default browser. If info is not nil, it is embedded as
+// <meta> tags. The html file is removed after args.webCleanup delay, if set.
+func renderAndOpen(buf *bytes.Buffer, info *replyInfo, args runArgs) error {
+	if args.webServe {
+		return serveAndOpen(htmlPage(buf.Bytes(), &args.md, info, args.attach))
+	}
 	f, err := os.CreateTemp("", "llmcli_*.html")
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	name := f.Name()
-	if _, err := f.WriteString(htmlHead); err != nil {
-		return err
+	if args.webKeep {
+		log.Printf("html saved to %s", name)
 	}
-	p := markdown.Parser{Table: true, AutoLinkText: true}
-	body := []byte(htmlHead)
-	body = append(body, markdown.ToHTML(p.Parse(buf.String()))...)
-	if _, err := f.Write(body); err != nil {
+	if _, err := f.Write(htmlPage(buf.Bytes(), &args.md, info, args.attach)); err != nil {
 		return err
 	}
 	if err := f.Close(); err != nil {
 		return err
 	}
+	if err := openInBrowser(name); err != nil {
+		return err
+	}
+	if args.webCleanup <= 0 {
+		return nil
+	}
+	// open commands return before browser reads the file
+	return removeLater(name, args.webCleanup)
+}
+
+// removeLater starts a background process that removes file once delay
+// passes, and returns without waiting for it, so that llmcli can exit right
+// away.
+func removeLater(file string, delay time.Duration) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		script := fmt.Sprintf("Start-Sleep -Milliseconds %d; Remove-Item -LiteralPath '%s'",
+			delay.Milliseconds(), strings.ReplaceAll(file, "'", "''"))
+		cmd = exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	} else {
+		secs := int((delay + time.Second - 1) / time.Second)
+		cmd = exec.Command("/bin/sh", "-c", `sleep "$1" && rm -f -- "$2"`, "sh", strconv.Itoa(secs), file)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("scheduling removal of %s: %w", file, err)
+	}
+	return cmd.Process.Release()
+}
+
+// serveAndOpen serves html page from an ephemeral http server on localhost
+// and opens it in the default browser. It returns once the page is fetched,
+// or after a minute if it never is.
+func serveAndOpen(page []byte) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	fetched := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(page)
+			once.Do(func() { close(fetched) })
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	if err := openInBrowser("http://" + ln.Addr().String() + "/"); err != nil {
+		return err
+	}
+	select {
+	case <-fetched:
+	case <-time.After(time.Minute):
+		return errors.New("browser didn't fetch the page within a minute")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
+
+// watchStopFile calls cancel once file name is created, or removed if it
+// exists at the time of the call. It polls the file until ctx is done.
+func watchStopFile(ctx context.Context, name string, cancel context.CancelFunc) {
+	exists := func() bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	existed := exists()
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if exists() != existed {
+				log.Printf("%s changed, stopping", name)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// openInBrowser opens file or url in the default browser.
+func openInBrowser(target string) error {
 	var openCmd string
 	switch runtime.GOOS {
 	case "darwin":
@@ -441,10 +2648,150 @@ func renderAndOpen(buf *bytes.Buffer) error {
 	case "windows":
 		openCmd = "explorer.exe"
 	default:
-		return fmt.Errorf("don't know how to open %q on %s", name, runtime.GOOS)
+		return fmt.Errorf("don't know how to open %q on %s", target, runtime.GOOS)
+	}
+	return exec.Command(openCmd, target).Run()
+}
+
+// embedImages replaces urls of images that refer to attached image files with
+// data: urls, so that html is self-contained. Image refers to an attached file
+// if its url is a local path matching either its full path or its base name;
+// remote urls are left as is.
+func embedImages(blocks []markdown.Block, attach []string) {
+	files := make(map[string]string) // url to file name
+	for _, name := range attach {
+		if strings.HasPrefix(name, "s3://") {
+			continue
+		}
+		files[filepath.ToSlash(filepath.Clean(name))] = name
+		files[filepath.Base(name)] = name
+	}
+	if len(files) == 0 {
+		return
+	}
+	walkImages(blocks, func(img *markdown.Image) {
+		u, err := url.Parse(img.URL)
+		if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+			return
+		}
+		name, ok := files[path.Clean(u.Path)]
+		if !ok {
+			return
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return
+		}
+		if data, err := appendDataURL(nil, b); err == nil {
+			img.URL = string(data)
+		}
+	})
+}
+
+// walkImages calls fn for every image found in blocks.
+func walkImages(blocks []markdown.Block, fn func(*markdown.Image)) {
+	var walkInlines func(markdown.Inlines)
+	walkInlines = func(inlines markdown.Inlines) {
+		for _, x := range inlines {
+			switch x := x.(type) {
+			case *markdown.Image:
+				fn(x)
+			case *markdown.Strong:
+				walkInlines(x.Inner)
+			case *markdown.Emph:
+				walkInlines(x.Inner)
+			case *markdown.Del:
+				walkInlines(x.Inner)
+			case *markdown.Link:
+				walkInlines(x.Inner)
+			}
+		}
+	}
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *markdown.Paragraph:
+			walkInlines(b.Text.Inline)
+		case *markdown.Heading:
+			walkInlines(b.Text.Inline)
+		case *markdown.Text:
+			walkInlines(b.Inline)
+		case *markdown.Quote:
+			walkImages(b.Blocks, fn)
+		case *markdown.List:
+			for _, item := range b.Items {
+				walkImages(item.(*markdown.Item).Blocks, fn)
+			}
+		case *markdown.Table:
+			for _, cell := range b.Header {
+				walkInlines(cell.Inline)
+			}
+			for _, row := range b.Rows {
+				for _, cell := range row {
+					walkInlines(cell.Inline)
+				}
+			}
+		}
+	}
+}
+
+// replyInfo describes the reply for the -frontmatter flag.
+type replyInfo struct {
+	model  string
+	time   time.Time
+	prompt string
+	usage  tokenUsage
+}
+
+// appendFrontmatter appends YAML frontmatter block describing the reply to dst.
+func (r *replyInfo) appendFrontmatter(dst []byte) []byte {
+	quote := func(s string) []byte {
+		// json string is also a valid YAML double-quoted scalar
+		b, _ := json.Marshal(s)
+		return b
+	}
+	dst = append(dst, "---\nmodel: "...)
+	dst = append(dst, quote(r.model)...)
+	dst = append(dst, "\ndate: "...)
+	dst = r.time.AppendFormat(dst, time.RFC3339)
+	dst = append(dst, "\nprompt: "...)
+	dst = append(dst, quote(r.prompt)...)
+	if r.usage.seen {
+		dst = fmt.Appendf(dst, "\ninput_tokens: %d\noutput_tokens: %d", r.usage.input, r.usage.output)
+	}
+	return append(dst, "\n---\n"...)
+}
+
+// appendMeta appends html <meta> tags describing the reply to dst.
+func (r *replyInfo) appendMeta(dst []byte) []byte {
+	meta := func(name, content string) {
+		dst = fmt.Appendf(dst, "<meta name=\"llmcli:%s\" content=\"%s\">\n", name, html.EscapeString(content))
 	}
-	return exec.Command(openCmd, name).Run()
+	meta("model", r.model)
+	meta("date", r.time.Format(time.RFC3339))
+	meta("prompt", r.prompt)
+	if r.usage.seen {
+		meta("input-tokens", strconv.Itoa(r.usage.input))
+		meta("output-tokens", strconv.Itoa(r.usage.output))
+	}
+	return dst
+}
+
+// saveMarkdown writes reply to file name, prefixed with frontmatter if info is
+// not nil.
+func saveMarkdown(name string, reply []byte, info *replyInfo) error {
+	var b []byte
+	if info != nil {
+		b = info.appendFrontmatter(b)
+	}
+	if err := os.WriteFile(name, append(b, reply...), 0666); err != nil {
+		return err
+	}
+	log.Printf("reply saved to %s", name)
+	return nil
 }
 
 //go:embed head.html
 var htmlHead string
+
+//go:embed mermaid.html
+var htmlMermaid string
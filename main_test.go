@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"pdf:a.pdf", []string{"pdf:a.pdf"}},
+		{"pdf:a.pdf  --pages 1-3", []string{"pdf:a.pdf", "--pages", "1-3"}},
+		{`pdf:"My Notes.pdf" --pages 1`, []string{"pdf:My Notes.pdf", "--pages", "1"}},
+		{`pdf:'My "Notes".pdf'`, []string{`pdf:My "Notes".pdf`}},
+		{`pdf:My\ Notes.pdf`, []string{"pdf:My Notes.pdf"}},
+		{`a "" b`, []string{"a", "", "b"}},
+	} {
+		got, err := splitArgs(tc.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tc.in, err)
+			continue
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{`"unterminated`, `'unterminated`, `trailing\`} {
+		if _, err := splitArgs(in); err == nil {
+			t.Errorf("splitArgs(%q) returned no error", in)
+		}
+	}
+}
+
+func TestSplitText(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		n    int
+		want []string
+	}{
+		{"", 3, nil},
+		{"abc", 3, []string{"abc"}},
+		{"abcdef", 3, []string{"abc", "def"}},
+		{"abcdefg", 3, []string{"abc", "def", "g"}},
+		// cut right after the last newline within the limit
+		{"ab\ncdef\ng", 5, []string{"ab\n", "cdef\n", "g"}},
+		// newline at the very start doesn't make an empty chunk
+		{"\nabcdef", 3, []string{"\nab", "cde", "f"}},
+		// limit is in characters, not bytes
+		{"привет", 4, []string{"прив", "ет"}},
+	} {
+		var got []string
+		for _, chunk := range splitText([]byte(tc.text), tc.n) {
+			got = append(got, string(chunk))
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("splitText(%q, %d) = %q, want %q", tc.text, tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestExpandIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "a text\n")
+	write("sub/b.txt", "b text\n@include c.txt\n") // relative to sub/
+	write("sub/c.txt", "c text")
+	write("self.txt", "@include self.txt\n")
+	write("loop1.txt", "@include loop2.txt\n")
+	write("loop2.txt", "@include loop1.txt\n")
+	for i := range 12 {
+		write(fmt.Sprintf("deep%d.txt", i), fmt.Sprintf("@include deep%d.txt\n", i+1))
+	}
+	write("deep12.txt", "bottom\n")
+
+	text := "start\n@include " + filepath.Join(dir, "a.txt") + "\n  @include " + filepath.Join(dir, "sub", "b.txt") + "  \nend"
+	got, err := expandIncludes(text, "prompt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "start\n" +
+		"<document><filename>a.txt</filename>\na text\n</document>\n" +
+		"<document><filename>b.txt</filename>\nb text\n" +
+		"<document><filename>c.txt</filename>\nc text\n</document>\n" +
+		"</document>\n" +
+		"end"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got, err := expandIncludes("no directives here\n", "prompt", nil); err != nil || got != "no directives here\n" {
+		t.Errorf("text without includes: got %q, %v", got, err)
+	}
+
+	for _, tc := range []struct {
+		name, wantErr string
+	}{
+		{"self.txt", "includes itself"},
+		{"loop1.txt", "includes itself"},
+		{"deep0.txt", "nested deeper than 10 levels"},
+		{"missing.txt", "prompt:2:"},
+	} {
+		_, err := expandIncludes("first line\n@include "+filepath.Join(dir, tc.name), "prompt", nil)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("including %s: got error %v, want one with %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestNumberLines(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"a", "1  a"},
+		{"a\n", "1  a\n"},
+		{"a\n\nb", "1  a\n2  \n3  b"},
+		{strings.Repeat("x\n", 10), " 1  x\n 2  x\n 3  x\n 4  x\n 5  x\n 6  x\n 7  x\n 8  x\n 9  x\n10  x\n"},
+	} {
+		if got := string(numberLines([]byte(tc.text))); got != tc.want {
+			t.Errorf("numberLines(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
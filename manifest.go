@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// manifest lists attachments of the request, to be able to tell later what
+// context the model saw.
+type manifest struct {
+	Time        time.Time       `json:"time"`
+	RequestID   string          `json:"request_id"`
+	Attachments []manifestEntry `json:"attachments"`
+}
+
+// manifestEntry describes a single attachment. Size and hash are of the
+// content as it was sent: for text attachments this is the text wrapped within
+// <document> tags, for the rest, the raw bytes. Attachments that don't come
+// from files are named after the flag that adds them, like "-since=command".
+type manifestEntry struct {
+	Path       string `json:"path"`
+	Format     string `json:"format"` // "text", or format of image, document, or audio
+	Size       int    `json:"size"`
+	SHA256     string `json:"sha256"`
+	Summarized bool   `json:"summarized,omitempty"` // summary was sent instead
+}
+
+// newManifestEntry describes attachment name that became blocks.
+func newManifestEntry(name string, blocks []types.ContentBlock) manifestEntry {
+	e := manifestEntry{Path: name}
+	h := sha256.New()
+	for _, b := range blocks {
+		var format string
+		var data []byte
+		switch b := b.(type) {
+		case *types.ContentBlockMemberText:
+			format, data = "text", []byte(b.Value)
+		case *types.ContentBlockMemberImage:
+			format = string(b.Value.Format)
+			if s, ok := b.Value.Source.(*types.ImageSourceMemberBytes); ok {
+				data = s.Value
+			}
+		case *types.ContentBlockMemberDocument:
+			format = string(b.Value.Format)
+			if s, ok := b.Value.Source.(*types.DocumentSourceMemberBytes); ok {
+				data = s.Value
+			}
+		case *types.ContentBlockMemberAudio:
+			format = string(b.Value.Format)
+			if s, ok := b.Value.Source.(*types.AudioSourceMemberBytes); ok {
+				data = s.Value
+			}
+		}
+		if e.Format == "" {
+			e.Format = format
+		}
+		e.Size += len(data)
+		h.Write(data)
+	}
+	e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return e
+}
+
+// writeManifest writes manifest of attachments to file name as json.
+func writeManifest(name, requestID string, entries []manifestEntry) error {
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	b, err := json.MarshalIndent(manifest{Time: time.Now(), RequestID: requestID, Attachments: entries}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(b, '\n'), 0666)
+}
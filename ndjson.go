@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ndjsonWriter presents reply as a stream of newline-delimited json objects:
+// one object per each written chunk of text, and a final object describing
+// how the reply ended.
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNdjsonWriter(w io.Writer) *ndjsonWriter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &ndjsonWriter{enc: enc}
+}
+
+type ndjsonEvent struct {
+	Type       string       `json:"type"`
+	Text       string       `json:"text,omitempty"`
+	StopReason string       `json:"stop_reason,omitempty"`
+	Usage      *ndjsonUsage `json:"usage,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+type ndjsonUsage struct {
+	Input  int `json:"input_tokens"`
+	Output int `json:"output_tokens"`
+	Total  int `json:"total_tokens"`
+}
+
+func (w *ndjsonWriter) Write(p []byte) (int, error) {
+	if _, err := w.WriteString(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *ndjsonWriter) WriteString(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if err := w.enc.Encode(ndjsonEvent{Type: "text", Text: s}); err != nil {
+		return 0, err
+	}
+	return len(s), nil
+}
+
+// Flush is a no-op, each chunk is written as soon as it arrives.
+func (w *ndjsonWriter) Flush() error { return nil }
+
+// finish writes the final object, err is the error the reply ended with, if any.
+func (w *ndjsonWriter) finish(stopReason string, usage *ndjsonUsage, err error) error {
+	evt := ndjsonEvent{Type: "stop", StopReason: stopReason, Usage: usage}
+	if err != nil {
+		evt.Error = err.Error()
+	}
+	return w.enc.Encode(evt)
+}
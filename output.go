@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"rsc.io/markdown"
+)
+
+// outputSink is a file or the system clipboard to save the complete reply
+// to, in the given format:
+//
+//   - md: as is, with frontmatter if -frontmatter is set (files only)
+//   - plain: converted to plain text, like with -plain
+//   - code: only fenced code blocks, like with -only-code
+//   - html: converted to a standalone html page, like with -w (files only)
+type outputSink struct {
+	format    string
+	name      string
+	clipboard bool // copy to the clipboard instead of the file name
+}
+
+// parseSink parses sink given as "format:file".
+func parseSink(val string) (outputSink, error) {
+	format, name, ok := strings.Cut(val, ":")
+	if !ok || name == "" {
+		return outputSink{}, errors.New("must be in the format:file form")
+	}
+	switch format {
+	case "md", "plain", "code", "html":
+		return outputSink{format: format, name: name}, nil
+	}
+	return outputSink{}, errors.New("format must be one of: md, plain, code, html")
+}
+
+// parseClipboardSink parses the format of the reply to copy to clipboard.
+func parseClipboardSink(format string) (outputSink, error) {
+	switch format {
+	case "md", "plain", "code":
+		return outputSink{format: format, clipboard: true}, nil
+	}
+	return outputSink{}, errors.New("format must be one of: md, plain, code")
+}
+
+// saveSinks writes reply to each of args.sinks, in their formats.
+func saveSinks(reply []byte, args runArgs, info *replyInfo) error {
+	for _, s := range args.sinks {
+		var err error
+		switch {
+		case s.clipboard:
+			b := reply
+			if s.format != "md" {
+				a := args
+				a.plain, a.onlyCode, a.firstCode = s.format == "plain", s.format == "code", false
+				var buf bytes.Buffer
+				if err := writeConverted(&buf, string(reply), a); err != nil {
+					return err
+				}
+				b = buf.Bytes()
+			}
+			if err := writeClipboard(b); err != nil {
+				return err
+			}
+			log.Print("reply copied to clipboard")
+			continue
+		case s.format == "md":
+			// logs on its own
+			if err := saveMarkdown(s.name, reply, info); err != nil {
+				return err
+			}
+			continue
+		case s.format == "plain", s.format == "code":
+			a := args
+			a.plain, a.onlyCode, a.firstCode = s.format == "plain", s.format == "code", false
+			var b bytes.Buffer
+			if err = writeConverted(&b, string(reply), a); err == nil {
+				err = os.WriteFile(s.name, b.Bytes(), 0666)
+			}
+		case s.format == "html":
+			err = os.WriteFile(s.name, htmlPage(reply, &args.md, info, args.attach), 0666)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("reply saved to %s", s.name)
+	}
+	return nil
+}
+
+// htmlPage converts Markdown content to a standalone HTML page using parser p.
+// If info is not nil, it is embedded as <meta> tags. Attached images the
+// reply refers to are embedded as data urls, and mermaid code blocks are
+// rendered as diagrams.
+func htmlPage(reply []byte, p *markdown.Parser, info *replyInfo, attach []string) []byte {
+	body := []byte(htmlHead)
+	if info != nil {
+		body = info.appendMeta(body)
+	}
+	doc := p.Parse(string(reply))
+	embedImages(doc.Blocks, attach)
+	hasDiagrams := mermaidDiagrams(doc.Blocks)
+	body = append(body, markdown.ToHTML(doc)...)
+	if hasDiagrams {
+		// only pages with diagrams load the renderer from the CDN
+		body = append(body, htmlMermaid...)
+	}
+	return body
+}
+
+// mermaidDiagrams replaces fenced code blocks of mermaid language within
+// blocks with <div class="mermaid"> elements, and reports whether there were
+// any.
+func mermaidDiagrams(blocks []markdown.Block) bool {
+	var found bool
+	for i, b := range blocks {
+		switch b := b.(type) {
+		case *markdown.CodeBlock:
+			if lang, _, _ := strings.Cut(strings.TrimSpace(b.Info), " "); lang != "mermaid" {
+				continue
+			}
+			text := make([]string, 0, len(b.Text)+2)
+			text = append(text, `<div class="mermaid">`)
+			for _, line := range b.Text {
+				text = append(text, html.EscapeString(line))
+			}
+			blocks[i] = &markdown.HTMLBlock{Position: b.Position, Text: append(text, "</div>")}
+			found = true
+		case *markdown.Quote:
+			found = mermaidDiagrams(b.Blocks) || found
+		case *markdown.List:
+			for _, item := range b.Items {
+				found = mermaidDiagrams(item.(*markdown.Item).Blocks) || found
+			}
+		}
+	}
+	return found
+}
+
+// logSummary logs the line of -summary: the models that made the reply, and
+// the time passed since start.
+func logSummary(models []string, start time.Time) {
+	d := time.Since(start)
+	if d >= time.Second {
+		d = d.Round(100 * time.Millisecond)
+	} else {
+		d = d.Round(time.Millisecond)
+	}
+	log.Printf("%s · %v", strings.Join(models, ", "), d)
+}
+
+// footerText expands {model} and {date} placeholders of -footer template.
+func footerText(tmpl, model string, now time.Time) string {
+	return strings.NewReplacer("{model}", model, "{date}", now.Format(time.DateOnly)).Replace(tmpl)
+}
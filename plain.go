@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"rsc.io/markdown"
+)
+
+// toPlainText renders markdown document as plain text: emphasis markers,
+// heading marks and code fences are dropped, links are rendered as
+// "text (url)".
+func toPlainText(doc *markdown.Document) string {
+	var sb strings.Builder
+	plainBlocks(&sb, doc.Blocks)
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
+
+// plainBlocks writes blocks to sb, separating them with empty lines.
+func plainBlocks(sb *strings.Builder, blocks []markdown.Block) {
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *markdown.Paragraph:
+			plainInlines(sb, b.Text.Inline)
+		case *markdown.Heading:
+			plainInlines(sb, b.Text.Inline)
+		case *markdown.Text:
+			plainInlines(sb, b.Inline)
+		case *markdown.CodeBlock:
+			for _, line := range b.Text {
+				sb.WriteString(line)
+				sb.WriteByte('\n')
+			}
+		case *markdown.HTMLBlock:
+			for _, line := range b.Text {
+				sb.WriteString(line)
+				sb.WriteByte('\n')
+			}
+		case *markdown.Quote:
+			var inner strings.Builder
+			plainBlocks(&inner, b.Blocks)
+			sb.WriteString(indentLines(strings.TrimRight(inner.String(), "\n"), "  ", "  "))
+		case *markdown.List:
+			plainList(sb, b)
+		case *markdown.Table:
+			plainRow(sb, b.Header)
+			for _, row := range b.Rows {
+				plainRow(sb, row)
+			}
+		case *markdown.ThematicBreak, *markdown.Empty:
+			continue
+		}
+		if s := sb.String(); !strings.HasSuffix(s, "\n") {
+			sb.WriteByte('\n')
+		}
+		sb.WriteByte('\n')
+	}
+}
+
+// plainList writes list items, each prefixed with either its number or a dash.
+func plainList(sb *strings.Builder, l *markdown.List) {
+	for i, item := range l.Items {
+		marker := "- "
+		if l.Bullet == '.' || l.Bullet == ')' {
+			marker = strconv.Itoa(l.Start+i) + ". "
+		}
+		var inner strings.Builder
+		plainBlocks(&inner, item.(*markdown.Item).Blocks)
+		text := strings.TrimRight(inner.String(), "\n")
+		if !l.Loose {
+			text = strings.ReplaceAll(text, "\n\n", "\n")
+		}
+		sb.WriteString(indentLines(text, marker, strings.Repeat(" ", len(marker))))
+		if l.Loose && i != len(l.Items)-1 {
+			sb.WriteByte('\n')
+		}
+	}
+}
+
+// plainRow writes table row cells separated by tabs.
+func plainRow(sb *strings.Builder, cells []*markdown.Text) {
+	for i, cell := range cells {
+		if i != 0 {
+			sb.WriteByte('\t')
+		}
+		plainInlines(sb, cell.Inline)
+	}
+	sb.WriteByte('\n')
+}
+
+func plainInlines(sb *strings.Builder, inlines markdown.Inlines) {
+	for _, x := range inlines {
+		switch x := x.(type) {
+		case *markdown.Plain:
+			sb.WriteString(x.Text)
+		case *markdown.Escaped:
+			sb.WriteString(x.Text)
+		case *markdown.Code:
+			sb.WriteString(x.Text)
+		case *markdown.Strong:
+			plainInlines(sb, x.Inner)
+		case *markdown.Emph:
+			plainInlines(sb, x.Inner)
+		case *markdown.Del:
+			plainInlines(sb, x.Inner)
+		case *markdown.Emoji:
+			sb.WriteString(x.Text)
+		case *markdown.HTMLTag:
+			sb.WriteString(x.Text)
+		case *markdown.SoftBreak, *markdown.HardBreak:
+			sb.WriteByte('\n')
+		case *markdown.Task:
+			if x.Checked {
+				sb.WriteString("[x] ")
+			} else {
+				sb.WriteString("[ ] ")
+			}
+		case *markdown.Link:
+			var inner strings.Builder
+			plainInlines(&inner, x.Inner)
+			sb.WriteString(inner.String())
+			if inner.String() != x.URL {
+				sb.WriteString(" (" + x.URL + ")")
+			}
+		case *markdown.Image:
+			plainInlines(sb, x.Inner)
+			sb.WriteString(" (" + x.URL + ")")
+		case *markdown.AutoLink:
+			sb.WriteString(x.Text)
+		case *markdown.FootnoteLink:
+			sb.WriteString("[" + x.Label + "]")
+		}
+	}
+}
+
+// indentLines prefixes the first line of text with first, and all the
+// following non-empty lines with rest.
+func indentLines(text, first, rest string) string {
+	var sb strings.Builder
+	for i, line := range strings.Split(text, "\n") {
+		switch {
+		case i == 0:
+			sb.WriteString(first)
+		case line != "":
+			sb.WriteString(rest)
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// convertReply reports whether the reply has to be buffered and converted
+// with writeConverted or -template instead of being written as it arrives.
+func (args *runArgs) convertReply() bool { return args.plain || args.onlyCode || args.template != nil }
+
+// writeConverted writes reply, parsed as markdown, to w in the form requested
+// by args: either as plain text, or as its fenced code blocks only.
+func writeConverted(w io.Writer, reply string, args runArgs) error {
+	doc := args.md.Parse(reply)
+	if args.plain {
+		_, err := io.WriteString(w, toPlainText(doc))
+		return err
+	}
+	var sb strings.Builder
+	for i, code := range codeBlocks(nil, doc.Blocks) {
+		if i != 0 {
+			if args.firstCode {
+				break
+			}
+			sb.WriteByte('\n')
+		}
+		for _, line := range code.Text {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// codeBlocks appends fenced code blocks found in blocks, including the nested
+// ones, to dst.
+func codeBlocks(dst []*markdown.CodeBlock, blocks []markdown.Block) []*markdown.CodeBlock {
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *markdown.CodeBlock:
+			if b.Fence != "" {
+				dst = append(dst, b)
+			}
+		case *markdown.Quote:
+			dst = codeBlocks(dst, b.Blocks)
+		case *markdown.List:
+			for _, item := range b.Items {
+				dst = codeBlocks(dst, item.(*markdown.Item).Blocks)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// polishSystemPrompt replaces the system prompt with -polish.
+const polishSystemPrompt = "You are an editor. You get a single Markdown document," +
+	" and improve its grammar, spelling, punctuation, and Markdown formatting," +
+	" keeping its meaning, structure, tone, and language intact." +
+	" Don't add new content, don't remove content, don't touch code blocks and urls." +
+	" Reply with the complete edited document only, as raw Markdown, without any comments" +
+	" and without wrapping it into a code block."
+
+// polishPrompt is the task prompt of -polish, sent after the attached document.
+const polishPrompt = "Polish the attached document."
+
+// checkPolishFile verifies that name is something -polish can work on: a
+// local Markdown file.
+func checkPolishFile(name string) error {
+	if strings.HasPrefix(name, "s3://") {
+		return errors.New("-polish only works with local files")
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown":
+	default:
+		return fmt.Errorf("-polish only works with Markdown files, %s doesn't look like one", name)
+	}
+	st, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", name)
+	}
+	return nil
+}
+
+// savePolished prints the difference between the file and its polished
+// version, and once confirmed over stdin, replaces the file with the polished
+// version, keeping the original one with .bak suffix.
+func savePolished(name string, polished []byte) error {
+	polished = append(bytes.TrimSpace(polished), '\n')
+	orig, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	differ, err := writeUnifiedDiff(os.Stdout, name, name+" (polished)", string(orig), string(polished))
+	if err != nil {
+		return err
+	}
+	if !differ {
+		log.Printf("%s needs no changes", name)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Overwrite %s with the changes above? [y/N] ", name)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return err
+	}
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		log.Printf("%s is left unchanged", name)
+		return nil
+	}
+	backup := name + ".bak"
+	if err := os.WriteFile(backup, orig, 0666); err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, polished, 0666); err != nil {
+		return err
+	}
+	log.Printf("%s updated, the original is saved to %s", name, backup)
+	return nil
+}
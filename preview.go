@@ -0,0 +1,86 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// previewAttachments converts attachments the same way they are converted for
+// the request, and writes to w what each of them becomes: text inlined into
+// the prompt, image, document, or audio, with its format and size in bytes.
+// Nothing is sent to the model.
+func previewAttachments(ctx context.Context, w io.Writer, args runArgs) error {
+	handler := loadHandlers()
+	chatgpt := args.config.useChatgpt()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ATTACHMENT\tSENT AS\tFORMAT\tBYTES\tNOTE")
+	var failed int
+	for i, name := range slices.Compact(args.attach) {
+		opts := args.att
+		opts.index = i + 1
+		blocks, err := handler.attToBlock(ctx, name, opts)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\terror: %v\n", name, err)
+			failed++
+			continue
+		}
+		for j, b := range blocks {
+			label := name
+			if len(blocks) > 1 {
+				label = fmt.Sprintf("%s (part %d/%d)", name, j+1, len(blocks))
+			}
+			var kind, format, note string
+			var size int
+			switch b := b.(type) {
+			case *types.ContentBlockMemberText:
+				kind, size = "inlined text", len(b.Value)
+				format = string(cmp.Or(opts.extFormats[strings.ToLower(filepath.Ext(name))],
+					docFormats[strings.ToLower(filepath.Ext(name))], types.DocumentFormatTxt))
+			case *types.ContentBlockMemberImage:
+				kind, format = "image", string(b.Value.Format)
+				if s, ok := b.Value.Source.(*types.ImageSourceMemberBytes); ok {
+					size = len(s.Value)
+				}
+			case *types.ContentBlockMemberDocument:
+				kind, format = "document", string(b.Value.Format)
+				if s, ok := b.Value.Source.(*types.DocumentSourceMemberBytes); ok {
+					size = len(s.Value)
+				}
+				if chatgpt {
+					if text, ok := documentText(name, b.Value, opts); ok {
+						kind, size = "inlined text", len(text)
+					} else {
+						note = "not supported by chatgpt"
+					}
+				}
+			case *types.ContentBlockMemberAudio:
+				kind, format = "audio", string(b.Value.Format)
+				if s, ok := b.Value.Source.(*types.AudioSourceMemberBytes); ok {
+					size = len(s.Value)
+				}
+				if chatgpt {
+					note = "not supported by chatgpt"
+				}
+			default:
+				kind = fmt.Sprintf("%T", b)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", label, kind, format, size, note)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed != 0 {
+		return errors.New("some attachments can't be sent")
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+// useResponsesAPI reports whether LLMCLI_OPENAI_RESPONSES asks to use OpenAI
+// Responses API instead of chat completions.
+func useResponsesAPI() bool {
+	ok, _ := strconv.ParseBool(os.Getenv("LLMCLI_OPENAI_RESPONSES"))
+	return ok
+}
+
+// responsesRequest is a request to OpenAI Responses API, see
+// https://platform.openai.com/docs/api-reference/responses/create
+type responsesRequest struct {
+	Model       string             `json:"model"`
+	Input       []responsesMessage `json:"input"`
+	Stream      bool               `json:"stream"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	TopP        *float32           `json:"top_p,omitempty"`
+	MaxTokens   *int32             `json:"max_output_tokens,omitempty"`
+	Tools       responsesTools     `json:"tools,omitempty"`
+	Store       bool               `json:"store"`
+}
+
+// responsesRequest translates chat completions request into its Responses
+// API counterpart.
+func (r *chatgptRequest) responsesRequest() *responsesRequest {
+	out := &responsesRequest{
+		Model:       r.Model,
+		Stream:      r.Stream,
+		Temperature: r.Temperature,
+		TopP:        r.TopP,
+		MaxTokens:   r.MaxTokens,
+		Tools:       responsesTools(r.Tools),
+	}
+	for _, m := range r.Messages {
+		out.Input = append(out.Input, responsesMessage(m))
+	}
+	return out
+}
+
+// responsesTools are tool definitions in the chat completions form, that
+// are marshaled in the form Responses API expects: function tools have their
+// name, description, and parameters at the top level instead of within the
+// "function" object. Other tools are passed as is.
+type responsesTools json.RawMessage
+
+func (t responsesTools) MarshalJSON() ([]byte, error) {
+	var tools []map[string]json.RawMessage
+	if err := json.Unmarshal(t, &tools); err != nil {
+		return nil, fmt.Errorf("tools must be a json array of objects: %w", err)
+	}
+	for i, tool := range tools {
+		fn, ok := tool["function"]
+		if !ok || string(tool["type"]) != `"function"` {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(fn, &fields); err != nil {
+			return nil, fmt.Errorf("tool %d: %w", i, err)
+		}
+		fields["type"] = tool["type"]
+		tools[i] = fields
+	}
+	return json.Marshal(tools)
+}
+
+// responsesMessage is a message in the form Responses API expects: the same
+// as in chat completions, but content parts are of different types.
+type responsesMessage message
+
+func (m responsesMessage) MarshalJSON() ([]byte, error) {
+	if len(m.Content) == 1 {
+		if _, ok := m.Content[0].(textBlock); ok {
+			msg := message(m)
+			return msg.MarshalJSON()
+		}
+	}
+	type part struct {
+		Type     string `json:"type"`
+		Text     string `json:"text,omitempty"`
+		ImageURL string `json:"image_url,omitempty"`
+	}
+	textType := "input_text"
+	if m.Role == "assistant" {
+		textType = "output_text"
+	}
+	parts := make([]part, 0, len(m.Content))
+	for _, c := range m.Content {
+		switch c := c.(type) {
+		case textBlock:
+			parts = append(parts, part{Type: textType, Text: string(c)})
+		case imageBlock:
+			u, err := appendDataURL(nil, c)
+			if err != nil {
+				return nil, fmt.Errorf("imageBlock: %w", err)
+			}
+			parts = append(parts, part{Type: "input_image", ImageURL: string(u)})
+		default:
+			return nil, fmt.Errorf("unsupported content type %T", c)
+		}
+	}
+	return json.Marshal(struct {
+		Role    string `json:"role"`
+		Content []part `json:"content"`
+	}{Role: m.Role, Content: parts})
+}
+
+// responsesReply is a complete reply of Responses API, either to
+// non-streaming request, or from the final event of a stream.
+type responsesReply struct {
+	Status  string `json:"status"`
+	Details *struct {
+		Reason string `json:"reason"`
+	} `json:"incomplete_details"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Output []struct {
+		Type    string `json:"type"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		responsesFunctionCall
+	} `json:"output"`
+	Usage *struct {
+		Input  int `json:"input_tokens"`
+		Output int `json:"output_tokens"`
+		Total  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// responsesFunctionCall is model's request to call a function
+type responsesFunctionCall struct {
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // json-encoded
+}
+
+func (r *responsesReply) usage() *chatgptUsage {
+	if r.Usage == nil {
+		return nil
+	}
+	return &chatgptUsage{Input: r.Usage.Input, Output: r.Usage.Output, Total: r.Usage.Total}
+}
+
+// text returns the text of all output messages.
+func (r *responsesReply) text() string {
+	var buf bytes.Buffer
+	for _, o := range r.Output {
+		if o.Type != "message" {
+			continue
+		}
+		for _, c := range o.Content {
+			if c.Type == "output_text" {
+				buf.WriteString(c.Text)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// stopReason returns the reason the reply ended for, and an error if it did
+// not end normally. It logs function calls the model requested.
+func (r *responsesReply) stopReason() (string, error) {
+	for _, o := range r.Output {
+		if o.Type == "function_call" {
+			log.Printf("model requested to use tool %s (id %s) with arguments: %s", o.Name, o.CallID, o.Arguments)
+		}
+	}
+	switch {
+	case r.Error != nil:
+		return r.Status, fmt.Errorf("%s: %s", r.Error.Code, r.Error.Message)
+	case r.Details != nil && r.Details.Reason == "content_filter":
+		return r.Details.Reason, &contentFilterError{stopReason: r.Details.Reason}
+	case r.Details != nil:
+		return r.Details.Reason, fmt.Errorf("stop reason: %s", r.Details.Reason)
+	case r.Status != "completed":
+		return r.Status, fmt.Errorf("response status: %s", r.Status)
+	}
+	return r.Status, nil
+}
+
+// readResponsesReply handles Responses API reply to non-streaming request,
+// the same way readResponse does for chat completions.
+func readResponsesReply(out io.Writer, r io.Reader, stats *textStats, limit *outputLimit) (*chatgptUsage, error) {
+	var msg responsesReply
+	if err := json.NewDecoder(r).Decode(&msg); err != nil {
+		return nil, err
+	}
+	stopReason, err := msg.stopReason()
+	text, ok := limit.take(msg.text())
+	if !ok && err == nil {
+		err = errOutputLimit
+	}
+	if stats != nil {
+		stats.WriteString(text)
+	}
+	if nd, ok := out.(*ndjsonWriter); ok {
+		nd.WriteString(text)
+		if err2 := nd.finish(stopReason, msg.usage().ndjson(), err); err == nil {
+			err = err2
+		}
+		return msg.usage(), err
+	}
+	if _, err := io.WriteString(out, text+"\n"); err != nil {
+		return msg.usage(), err
+	}
+	return msg.usage(), err
+}
+
+// streamResponsesReply handles Responses API reply to streaming request, the
+// same way streamResponse does for chat completions.
+func streamResponsesReply(out io.Writer, r io.Reader, stats *textStats, limit *outputLimit) (tokenUsage *chatgptUsage, err error) {
+	// https://platform.openai.com/docs/api-reference/responses-streaming
+	var stopReason string
+	nd, _ := out.(*ndjsonWriter)
+	defer func() {
+		if nd != nil {
+			if err2 := nd.finish(stopReason, tokenUsage.ndjson(), err); err == nil {
+				err = err2
+			}
+		}
+	}()
+	type event struct {
+		Type     string          `json:"type"`
+		Delta    string          `json:"delta"`
+		Response *responsesReply `json:"response"`
+		Code     string          `json:"code"`
+		Message  string          `json:"message"`
+	}
+	var w interface {
+		io.StringWriter
+		Flush() error
+	} = bufio.NewWriterSize(out, 4096)
+	if nd != nil {
+		w = nd
+	}
+	defer w.Flush()
+	fr := &flushingReader{r: r, w: w}
+	sc := bufio.NewScanner(fr)
+	// final event carries the whole reply
+	sc.Buffer(nil, maxDocumentSize)
+	for sc.Scan() {
+		if fr.err != nil {
+			return tokenUsage, fr.err
+		}
+		const dataPrefix = "data: "
+		b := sc.Bytes()
+		if !bytes.HasPrefix(b, []byte(dataPrefix)) {
+			continue
+		}
+		var evt event
+		if err := json.Unmarshal(b[len(dataPrefix):], &evt); err != nil {
+			return tokenUsage, err
+		}
+		switch evt.Type {
+		case "response.output_text.delta":
+			text, ok := limit.take(evt.Delta)
+			if _, err := w.WriteString(text); err != nil {
+				return tokenUsage, err
+			}
+			if stats != nil {
+				stats.WriteString(text)
+			}
+			if !ok {
+				if nd == nil {
+					w.WriteString("\n")
+				}
+				return tokenUsage, errOutputLimit
+			}
+		case "response.completed", "response.incomplete", "response.failed":
+			if evt.Response == nil {
+				return tokenUsage, fmt.Errorf("%s event without response", evt.Type)
+			}
+			tokenUsage = evt.Response.usage()
+			if nd == nil {
+				w.WriteString("\n")
+			}
+			stopReason, err = evt.Response.stopReason()
+			if err != nil {
+				return tokenUsage, err
+			}
+			return tokenUsage, w.Flush()
+		case "error":
+			return tokenUsage, fmt.Errorf("%s: %s", evt.Code, evt.Message)
+		}
+	}
+	if fr.err != nil {
+		return tokenUsage, fr.err
+	}
+	if err := sc.Err(); err != nil {
+		return tokenUsage, streamError(err)
+	}
+	if nd == nil {
+		w.WriteString("\n")
+	}
+	return tokenUsage, errTruncated
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// contentBlockFromS3 fetches S3 object given as s3://bucket/key and converts
+// it into content blocks the same way as a local file.
+func contentBlockFromS3(ctx context.Context, uri string, opts blockOptions) ([]types.ContentBlock, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("%s: S3 url must be in the s3://bucket/key form", uri)
+	}
+	cfg, setup, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, credentialsError(err, setup)
+	}
+	out, err := s3.NewFromConfig(cfg).GetObject(ctx, &s3.GetObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && ae.ErrorCode() == "AccessDenied" {
+			return nil, fmt.Errorf("%s: access denied, check that your AWS credentials allow s3:GetObject on it", uri)
+		}
+		return nil, fmt.Errorf("%s: %w", uri, credentialsError(err, setup))
+	}
+	defer out.Body.Close()
+	if aws.ToInt64(out.ContentLength) > maxDocumentSize {
+		return nil, errors.New("maximum document size supported is 50Mb")
+	}
+	b, err := io.ReadAll(io.LimitReader(out.Body, maxDocumentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", uri, err)
+	}
+	if len(b) > maxDocumentSize {
+		return nil, errors.New("maximum document size supported is 50Mb")
+	}
+	if out.LastModified != nil {
+		opts.modTime = *out.LastModified
+	}
+	return contentBlockFromBytes(uri, b, objectContentType(aws.ToString(out.ContentType), b), opts)
+}
+
+// objectContentType returns content-type of S3 object with content b, using
+// its metadata ct if it's specific enough, and falling back to detection.
+func objectContentType(ct string, b []byte) string {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	switch {
+	case err != nil, mediaType == "binary/octet-stream", mediaType == "application/octet-stream":
+		return http.DetectContentType(b)
+	case mediaType == "text/plain" && utf8.Valid(b):
+		// the same form http.DetectContentType reports for utf8 text
+		return "text/plain; charset=utf-8"
+	}
+	return mediaType
+}
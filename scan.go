@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"regexp"
+)
+
+// injectionPatterns match phrases typical for attempts to give the model
+// instructions from within a document. Matching is a heuristic, expect both
+// false positives and misses.
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget)\s+(all\s+|any\s+)?(the\s+|your\s+)?(previous|prior|above|earlier|preceding)\s+(instructions|prompts?|directions|rules)`),
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget)\s+(all\s+|any\s+)?(your|the)\s+(instructions|system\s+prompt|rules)`),
+	regexp.MustCompile(`(?i)\bnew\s+instructions\s*:`),
+	regexp.MustCompile(`(?i)\byou\s+are\s+now\s+(a|an|in)\b`),
+	regexp.MustCompile(`(?i)\b(reveal|print|show|repeat)\s+(me\s+)?(your|the)\s+system\s+prompt`),
+	regexp.MustCompile(`(?i)</?(document|system|instructions?)>`),
+}
+
+// warnInjections logs a warning for every phrase in text of the attachment
+// name that looks like an attempt of prompt injection.
+func warnInjections(name string, text []byte) {
+	for _, re := range injectionPatterns {
+		for _, m := range re.FindAll(text, -1) {
+			log.Printf("warning: %s may contain prompt injection: %q", name, m)
+		}
+	}
+}
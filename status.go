@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// checkStatus makes a minimal authenticated call to the active provider and
+// reports the configuration used to w, so that credential problems surface
+// before the actual prompt is sent.
+func checkStatus(ctx context.Context, w io.Writer, headers http.Header, cfg *fileConfig) error {
+	if cfg.useChatgpt() {
+		return chatgptStatus(ctx, w, headers, cfg.chatgptModel())
+	}
+	cl, setup, err := bedrockClient(ctx, nil)
+	if err != nil {
+		return credentialsError(err, setup)
+	}
+	model := cfg.modelChain(false)[0]
+	_, err = cl.Converse(ctx, &bedrockruntime.ConverseInput{
+		ModelId: &model,
+		Messages: []types.Message{{
+			Role:    types.ConversationRoleUser,
+			Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: "Hi"}},
+		}},
+		InferenceConfig: &types.InferenceConfiguration{MaxTokens: aws.Int32(1)},
+	})
+	if err != nil {
+		return fmt.Errorf("model %s, region %s, profile %s: %w", model, setup.region, setup.profile, credentialsError(err, setup))
+	}
+	fmt.Fprintf(w, "OK: model %s, region %s, profile %s\n", model, setup.region, setup.profile)
+	if setup.endpoint != "" {
+		fmt.Fprintf(w, "endpoint: %s\n", setup.endpoint)
+	}
+	return nil
+}
+
+// chatgptStatus checks that OpenAI API token is valid and the configured
+// model is available to it (with Azure OpenAI, only the key is checked).
+// Headers are added to the request.
+func chatgptStatus(ctx context.Context, w io.Writer, headers http.Header, model string) error {
+	api, err := newOpenaiAPI(model)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api.statusURL, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range api.auth {
+		req.Header[k] = v
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &unexpectedStatusError{code: resp.StatusCode}
+		buf := make([]byte, 1024)
+		n, _ := io.ReadFull(resp.Body, buf)
+		if buf = buf[:n]; len(buf) != 0 {
+			statusErr.text = string(buf)
+		}
+		return fmt.Errorf("model %s: %w", model, statusErr)
+	}
+	fmt.Fprintf(w, "OK: model %s\n", model)
+	return nil
+}
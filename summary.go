@@ -0,0 +1,75 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// summarySpan marks content blocks of a single attachment that has to be
+// replaced with its summary.
+type summarySpan struct {
+	start, end int // range of content blocks
+	name       string
+	opts       blockOptions
+	entry      int // index of the attachment in -manifest entries, if any
+}
+
+// textLength returns the number of characters in text blocks, or -1 if there
+// are blocks of other types.
+func textLength(blocks []types.ContentBlock) int {
+	var n int
+	for _, b := range blocks {
+		tb, ok := b.(*types.ContentBlockMemberText)
+		if !ok {
+			return -1
+		}
+		n += utf8.RuneCountInString(tb.Value)
+	}
+	return n
+}
+
+// summaryModel returns id of the model used to summarize large attachments.
+func summaryModel() string { return modelAlias(cmp.Or(os.Getenv("LLMCLI_SUMMARY_MODEL"), "haiku")) }
+
+const summaryPrompt = "Summarize the document above. Keep all the facts, names, numbers," +
+	" and conclusions that may matter for questions about it, drop the rest." +
+	" Reply with the summary only."
+
+// summarizeAttachment asks the summary model to summarize text blocks of a
+// single attachment, and returns a block with that summary, marked with
+// summary="true" attribute of <document> tag.
+func summarizeAttachment(ctx context.Context, cl *bedrockruntime.Client, blocks []types.ContentBlock, s summarySpan, metadata map[string]string) (types.ContentBlock, error) {
+	model := summaryModel()
+	content := append(blocks[:len(blocks):len(blocks)], &types.ContentBlockMemberText{Value: summaryPrompt})
+	out, err := cl.Converse(ctx, &bedrockruntime.ConverseInput{
+		ModelId:         &model,
+		Messages:        []types.Message{{Role: types.ConversationRoleUser, Content: content}},
+		RequestMetadata: metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("summarizing %s with %s: %w", s.name, model, err)
+	}
+	msg, ok := out.Output.(*types.ConverseOutputMemberMessage)
+	if !ok {
+		return nil, fmt.Errorf("summarizing %s with %s: unexpected output type %T", s.name, model, out.Output)
+	}
+	var sb strings.Builder
+	for _, b := range msg.Value.Content {
+		if tb, ok := b.(*types.ContentBlockMemberText); ok {
+			sb.WriteString(tb.Value)
+		}
+	}
+	if strings.TrimSpace(sb.String()) == "" {
+		return nil, errors.New("summarizing " + s.name + ": got empty summary")
+	}
+	text := appendDocument(nil, "document", s.opts.docAttrs()+` summary="true"`, s.name, []byte(sb.String()))
+	return &types.ContentBlockMemberText{Value: string(text)}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// parseTemplate parses -template value: either the template itself, or the
+// name of the file holding it, prefixed with @.
+func parseTemplate(val string) (*template.Template, error) {
+	text := val
+	if name, ok := strings.CutPrefix(val, "@"); ok {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("empty template")
+	}
+	return template.New("template").Option("missingkey=error").Parse(text)
+}
+
+// templateData is what -template is executed with.
+type templateData struct {
+	Text  string // the complete reply, with surrounding whitespace trimmed
+	Model string
+	Usage struct{ Input, Output, Total int }
+	Date  time.Time
+}
+
+// writeTemplate executes template t with the reply and its details, and
+// writes the result to w.
+func writeTemplate(w io.Writer, t *template.Template, reply, model string, usage tokenUsage) error {
+	data := templateData{Text: strings.TrimSpace(reply), Model: model, Date: time.Now()}
+	data.Usage.Input, data.Usage.Output, data.Usage.Total = usage.input, usage.output, usage.total
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return fmt.Errorf("executing -template: %w", err)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}